@@ -7,29 +7,39 @@ import (
 	"crypto/rand"
 	"crypto/x509"
 	"crypto/x509/pkix"
-	"encoding/asn1"
 	"fmt"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 
 	"felix-hartmond.de/projects/certbutler/common"
+	"felix-hartmond.de/projects/certbutler/storage"
 	"golang.org/x/crypto/acme"
 )
 
-func loadAccount(ctx context.Context, accountFile string, acmeDirectory string) (*acme.Client, error) {
-	akey, err := common.LoadKeyFromPEMFile(accountFile, 0)
+// loadAccount loads the account key and checks the account. If register is set, a missing account is registered.
+// A stored key which cannot be loaded (e.g. a wrong passphrase) is never replaced.
+func loadAccount(ctx context.Context, store storage.Storage, acmeDirectory string, register bool) (*acme.Client, error) {
+	akey, err := store.GetAccountKey()
+	if err == storage.ErrNotFound && register {
+		return registerAccount(ctx, store, acmeDirectory)
+	}
 	if err != nil {
 		return nil, err
 	}
 
 	client := &acme.Client{Key: akey, DirectoryURL: acmeDirectory}
 	_, err = client.GetReg(ctx, "")
+	if err == acme.ErrNoAccount && register {
+		// the CA does not know the key (e.g. a new acme directory) => register it instead of replacing it
+		log.Println("Registering existing account key")
+		_, err = client.Register(ctx, &acme.Account{}, acme.AcceptTOS)
+	}
 
 	return client, err
 }
 
-func registerAccount(ctx context.Context, accountFile string, acmeDirectory string) (*acme.Client, error) {
+func registerAccount(ctx context.Context, store storage.Storage, acmeDirectory string) (*acme.Client, error) {
 	akey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 	if err != nil {
 		return nil, err
@@ -41,7 +51,7 @@ func registerAccount(ctx context.Context, accountFile string, acmeDirectory stri
 		return nil, err
 	}
 
-	err = common.SaveToPEMFile(accountFile, akey, nil)
+	err = store.PutAccountKey(akey)
 	if err != nil {
 		return nil, err
 	}
@@ -49,19 +59,24 @@ func registerAccount(ctx context.Context, accountFile string, acmeDirectory stri
 }
 
 // RequestCertificate runs the acme flow to request a certificate with the desired contents
-func RequestCertificate(certificateConfig common.CertificateConfiguration) ([][]byte, *ecdsa.PrivateKey, error) {
-	ctx := context.Background()
-	var client *acme.Client
-	var err error
-
-	client, err = loadAccount(ctx, certificateConfig.AcmeAccountFile, certificateConfig.AcmeDirectory)
+// The acme account key is loaded from and registered to the given storage. Cancelling ctx aborts the flow.
+// The URL of the order is returned as well, also if the order fails after it was created.
+func RequestCertificate(ctx context.Context, certificateConfig common.CertificateConfiguration, store storage.Storage) ([][]byte, *ecdsa.PrivateKey, string, error) {
+	client, err := loadAccount(ctx, store, certificateConfig.AcmeDirectory, certificateConfig.RegisterAcme)
 	if err != nil {
-		if !certificateConfig.RegisterAcme {
-			return nil, nil, err
+		return nil, nil, "", err
+	}
+
+	if certificateConfig.CheckCAA {
+		log.Println("Checking CAA records")
+
+		directory, err := client.Discover(ctx)
+		if err != nil {
+			return nil, nil, "", err
 		}
-		client, err = registerAccount(ctx, certificateConfig.AcmeAccountFile, certificateConfig.AcmeDirectory)
+		err = checkCAA(ctx, certificateConfig.DNSNames, directory.CAA, certificateConfig.CAAResolver)
 		if err != nil {
-			return nil, nil, err
+			return nil, nil, "", err
 		}
 	}
 
@@ -69,7 +84,7 @@ func RequestCertificate(certificateConfig common.CertificateConfiguration) ([][]
 
 	order, err := client.AuthorizeOrder(ctx, acme.DomainIDs(certificateConfig.DNSNames...))
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, "", err
 	}
 
 	log.Println("Authorizing domains")
@@ -80,7 +95,7 @@ func RequestCertificate(certificateConfig common.CertificateConfiguration) ([][]
 	for _, authURL := range order.AuthzURLs {
 		authz, err := client.GetAuthorization(ctx, authURL)
 		if err != nil {
-			return nil, nil, err
+			return nil, nil, order.URI, err
 		}
 
 		if authz.Status == acme.StatusValid {
@@ -97,12 +112,12 @@ func RequestCertificate(certificateConfig common.CertificateConfiguration) ([][]
 			}
 		}
 		if chal == nil {
-			return nil, nil, fmt.Errorf("No dns-01 challenge for %q", authURL)
+			return nil, nil, order.URI, fmt.Errorf("No dns-01 challenge for %q", authURL)
 		}
 
 		val, err := client.DNS01ChallengeRecord(chal.Token)
 		if err != nil {
-			return nil, nil, fmt.Errorf("dns-01 token for %q: %v", authz.Identifier, err)
+			return nil, nil, order.URI, fmt.Errorf("dns-01 token for %q: %w", authz.Identifier, err)
 		}
 
 		log.Printf("Hosting dns challenge for %s: %s\n", authz.Identifier, val)
@@ -112,32 +127,39 @@ func RequestCertificate(certificateConfig common.CertificateConfiguration) ([][]
 	}
 
 	if len(pendigChallenges) > 0 {
-		// Preparing authorizations - Start DNS server
+		// Preparing authorizations - Start DNS server; it is stopped when authorizations are done, failed or cancelled
 		closeServer := hostDNS(dnsTokens)
+		stopServer := func() {
+			if closeServer != nil {
+				closeServer <- true
+				closeServer = nil
+			}
+		}
+		defer stopServer()
 
 		log.Println("Accepting pending challenges")
 		for _, chal := range pendigChallenges {
 			if _, err := client.Accept(ctx, chal); err != nil {
-				return nil, nil, fmt.Errorf("dns-01 accept for %q: %v", chal, err)
+				return nil, nil, order.URI, fmt.Errorf("dns-01 accept for %q: %w", chal, err)
 			}
 		}
 
 		log.Println("Waiting for authorizations...")
 		for _, authURL := range order.AuthzURLs {
 			if _, err := client.WaitAuthorization(ctx, authURL); err != nil {
-				return nil, nil, fmt.Errorf("Authorization for %q failed: %v", authURL, err)
+				return nil, nil, order.URI, fmt.Errorf("Authorization for %q failed: %w", authURL, err)
 			}
 		}
 
 		// Authorizations done - Stop DNS server
-		closeServer <- true
+		stopServer()
 	}
 
 	log.Println("Generating PrivateKey and CSR")
 
 	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, order.URI, err
 	}
 
 	req := &x509.CertificateRequest{
@@ -146,29 +168,34 @@ func RequestCertificate(certificateConfig common.CertificateConfiguration) ([][]
 
 	if certificateConfig.MustStaple {
 		req.ExtraExtensions = append(req.ExtraExtensions, pkix.Extension{
-			Id:    asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 24},
+			Id:    oidMustStaple,
 			Value: []byte{0x30, 0x03, 0x02, 0x01, 0x05},
 		})
 	}
 
 	csr, err := x509.CreateCertificateRequest(rand.Reader, req, key)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, order.URI, err
 	}
 
 	log.Println("Requesting certificate")
 
 	crts, _, err := client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, order.URI, err
 	}
 
-	return crts, key, nil
+	return crts, key, order.URI, nil
 }
 
 // CheckCertRenew checks if the stored certificate exists and is still longer valid than renewalduecert from config
-func CheckCertRenew(certFile string, renewalDueCert int) bool {
-	cert, err := common.LoadCertFromPEMFile(certFile, 0)
+func CheckCertRenew(store storage.Storage, renewalDueCert int) bool {
+	bundle, err := store.GetCertificate()
+	if err != nil {
+		// no certificate => request cert
+		return true
+	}
+	cert, err := bundle.Leaf()
 	if err != nil {
 		// no or invalid certificate => request cert
 		return true
@@ -0,0 +1,148 @@
+package acme
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// checkCAA verifies that the CAA records of all names allow issuance by a CA with one of the given caaIdentities (RFC 8659)
+// The returned error lists every name which blocks issuance.
+func checkCAA(ctx context.Context, dnsNames []string, caaIdentities []string, resolver string) error {
+	if len(caaIdentities) == 0 {
+		log.Warn("ACME directory does not announce CAA identities, skipping CAA check")
+		return nil
+	}
+
+	if resolver == "" {
+		clientConfig, err := dns.ClientConfigFromFile("/etc/resolv.conf")
+		if err != nil || len(clientConfig.Servers) == 0 {
+			return fmt.Errorf("No resolver for CAA check configured and none found in /etc/resolv.conf")
+		}
+		resolver = net.JoinHostPort(clientConfig.Servers[0], clientConfig.Port)
+	} else if _, _, err := net.SplitHostPort(resolver); err != nil {
+		resolver = net.JoinHostPort(resolver, "53")
+	}
+
+	blocking := []string{}
+	for _, name := range dnsNames {
+		allowed, reason, err := caaAllowsIssuance(ctx, name, caaIdentities, resolver)
+		if err != nil {
+			return fmt.Errorf("CAA lookup for %s failed: %w", name, err)
+		}
+		if !allowed {
+			blocking = append(blocking, fmt.Sprintf("%s (%s)", name, reason))
+		}
+	}
+
+	if len(blocking) > 0 {
+		return fmt.Errorf("CAA records forbid issuance by %s for: %s", strings.Join(caaIdentities, ","), strings.Join(blocking, ", "))
+	}
+	return nil
+}
+
+// caaAllowsIssuance determines the relevant CAA record set of a name by climbing the DNS tree and checks it against the CA identities
+func caaAllowsIssuance(ctx context.Context, name string, caaIdentities []string, resolver string) (bool, string, error) {
+	wildcard := strings.HasPrefix(name, "*.")
+	fqdn := dns.Fqdn(strings.TrimPrefix(name, "*."))
+
+	labels := dns.SplitDomainName(fqdn)
+	for i := range labels {
+		domain := dns.Fqdn(strings.Join(labels[i:], "."))
+		records, err := lookupCAA(ctx, domain, resolver)
+		if err != nil {
+			return false, "", err
+		}
+		if len(records) == 0 {
+			continue
+		}
+		allowed, reason := evaluateCAASet(records, caaIdentities, wildcard)
+		if !allowed {
+			reason = fmt.Sprintf("%s at %s", reason, domain)
+		}
+		return allowed, reason, nil
+	}
+
+	// no CAA records anywhere in the tree => every CA is allowed
+	return true, "", nil
+}
+
+// evaluateCAASet checks a relevant CAA record set against the CA identities
+func evaluateCAASet(records []*dns.CAA, caaIdentities []string, wildcard bool) (bool, string) {
+	issue := []*dns.CAA{}
+	issueWild := []*dns.CAA{}
+	for _, record := range records {
+		switch strings.ToLower(record.Tag) {
+		case "issue":
+			issue = append(issue, record)
+		case "issuewild":
+			issueWild = append(issueWild, record)
+		case "iodef":
+		default:
+			if record.Flag&128 != 0 {
+				return false, fmt.Sprintf("unknown critical property %q", record.Tag)
+			}
+		}
+	}
+
+	relevant := issue
+	if wildcard && len(issueWild) > 0 {
+		relevant = issueWild
+	}
+	if len(relevant) == 0 {
+		// record set does not restrict issuance (e.g. only iodef)
+		return true, ""
+	}
+
+	for _, record := range relevant {
+		issuer := strings.TrimSpace(strings.SplitN(record.Value, ";", 2)[0])
+		for _, identity := range caaIdentities {
+			if issuer != "" && strings.EqualFold(issuer, identity) {
+				return true, ""
+			}
+		}
+	}
+
+	values := []string{}
+	for _, record := range relevant {
+		values = append(values, fmt.Sprintf("%s %q", record.Tag, record.Value))
+	}
+	return false, "allowed: " + strings.Join(values, ", ")
+}
+
+// lookupCAA queries the CAA records of a domain. Non-existing domains result in an empty set.
+func lookupCAA(ctx context.Context, domain, resolver string) ([]*dns.CAA, error) {
+	msg := new(dns.Msg)
+	msg.SetQuestion(domain, dns.TypeCAA)
+	msg.RecursionDesired = true
+	msg.SetEdns0(4096, false)
+
+	client := &dns.Client{}
+	response, _, err := client.ExchangeContext(ctx, msg, resolver)
+	if err == nil && response.Truncated {
+		client.Net = "tcp"
+		response, _, err = client.ExchangeContext(ctx, msg, resolver)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	switch response.Rcode {
+	case dns.RcodeSuccess, dns.RcodeNameError:
+	default:
+		// e.g. SERVFAIL, which the resolver may not answer on the next attempt
+		return nil, &net.DNSError{Err: "resolver answered " + dns.RcodeToString[response.Rcode], Name: domain, Server: resolver, IsTemporary: true}
+	}
+
+	records := []*dns.CAA{}
+	for _, rr := range response.Answer {
+		if caa, ok := rr.(*dns.CAA); ok {
+			records = append(records, caa)
+		}
+	}
+	return records, nil
+}
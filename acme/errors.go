@@ -0,0 +1,20 @@
+package acme
+
+import (
+	"errors"
+	"net"
+
+	"golang.org/x/crypto/acme"
+)
+
+// Retryable returns whether a failed certificate request may succeed when it is repeated
+// Only network errors and server errors of the CA are temporary. Problems the CA reports for the request (e.g. rateLimited,
+// unauthorized or rejectedIdentifier), failed authorizations, CAA records forbidding issuance and configuration errors are not.
+func Retryable(err error) bool {
+	var acmeErr *acme.Error
+	if errors.As(err, &acmeErr) {
+		return acmeErr.StatusCode >= 500
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
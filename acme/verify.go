@@ -0,0 +1,141 @@
+package acme
+
+import (
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/asn1"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"felix-hartmond.de/projects/certbutler/common"
+)
+
+const (
+	maxClockSkew = time.Hour
+	maxLifetime  = 398 * 24 * time.Hour
+)
+
+var oidMustStaple = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 24}
+
+// VerifyCertificate checks an issued certificate chain before it is deployed.
+// The leaf has to match the key, cover exactly the configured names, contain must-staple if requested,
+// chain to a trusted root and have a sane validity period.
+func VerifyCertificate(certs [][]byte, key *ecdsa.PrivateKey, certificateConfig common.CertificateConfiguration) error {
+	if len(certs) == 0 {
+		return fmt.Errorf("Received no certificates")
+	}
+	if key == nil {
+		return fmt.Errorf("No private key for certificate")
+	}
+
+	chain := []*x509.Certificate{}
+	for _, der := range certs {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return fmt.Errorf("Parsing received certificate failed: %v", err)
+		}
+		chain = append(chain, cert)
+	}
+	leaf := chain[0]
+
+	// key
+	publicKey, ok := leaf.PublicKey.(*ecdsa.PublicKey)
+	if !ok || !publicKey.Equal(key.Public()) {
+		return fmt.Errorf("Certificate does not match the generated private key")
+	}
+
+	// names
+	if !sameNames(leaf.DNSNames, certificateConfig.DNSNames) {
+		return fmt.Errorf("Certificate names %s do not match the configured names %s", common.FlattenStringSlice(leaf.DNSNames), common.FlattenStringSlice(certificateConfig.DNSNames))
+	}
+
+	// must staple
+	if certificateConfig.MustStaple && !hasExtension(leaf, oidMustStaple) {
+		return fmt.Errorf("Certificate is missing the requested must-staple extension")
+	}
+
+	// validity
+	now := time.Now()
+	if leaf.NotBefore.After(now.Add(maxClockSkew)) {
+		return fmt.Errorf("Certificate is not valid before %s", leaf.NotBefore)
+	}
+	if !leaf.NotAfter.After(now) {
+		return fmt.Errorf("Certificate already expired at %s", leaf.NotAfter)
+	}
+	if lifetime := leaf.NotAfter.Sub(leaf.NotBefore); lifetime > maxLifetime {
+		return fmt.Errorf("Certificate lifetime of %d days exceeds the maximum of %d days", lifetime/(24*time.Hour), maxLifetime/(24*time.Hour))
+	}
+
+	// chain
+	roots, err := loadTrustedRoots(certificateConfig.TrustedRootsFile)
+	if err != nil {
+		return err
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range chain[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err = leaf.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	if err != nil {
+		return fmt.Errorf("Certificate chain verification failed: %v", err)
+	}
+
+	return nil
+}
+
+// loadTrustedRoots loads all certificates from a pem file as root pool. Without a file the system roots are used.
+func loadTrustedRoots(rootsFile string) (*x509.CertPool, error) {
+	if rootsFile == "" {
+		return x509.SystemCertPool()
+	}
+
+	bundle, err := common.LoadBundle(rootsFile)
+	if err != nil {
+		return nil, fmt.Errorf("Loading trusted roots from %s failed: %v", rootsFile, err)
+	}
+	if len(bundle.Certificates) == 0 {
+		return nil, fmt.Errorf("No trusted roots found in %s", rootsFile)
+	}
+
+	roots := x509.NewCertPool()
+	for _, cert := range bundle.Certificates {
+		roots.AddCert(cert)
+	}
+	return roots, nil
+}
+
+func sameNames(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	normalize := func(names []string) []string {
+		normalized := make([]string, 0, len(names))
+		for _, name := range names {
+			normalized = append(normalized, strings.ToLower(name))
+		}
+		sort.Strings(normalized)
+		return normalized
+	}
+	na, nb := normalize(a), normalize(b)
+	for i := range na {
+		if na[i] != nb[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func hasExtension(cert *x509.Certificate, oid asn1.ObjectIdentifier) bool {
+	for _, extension := range cert.Extensions {
+		if extension.Id.Equal(oid) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,60 @@
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"felix-hartmond.de/projects/certbutler/common"
+)
+
+const defaultLease = time.Hour
+
+// Elector decides which of the nodes sharing a certificate is the leader talking to the CA
+// Other backends (e.g. a lease in consul or etcd) can be added by implementing this interface.
+type Elector interface {
+	// Acquire tries to become leader or extends the own leadership and returns whether this node is the leader
+	Acquire(ctx context.Context) (bool, error)
+	// Release gives up the leadership, so another node can take over immediately
+	Release() error
+}
+
+// New creates the elector selected in the configuration; nil means no cluster mode
+// runInterval is the longest time between two scheduled runs (0 for single runs); it determines the default lease duration.
+func New(config common.ClusterConfiguration, runInterval time.Duration) (Elector, error) {
+	nodeID := config.NodeID
+	if nodeID == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, err
+		}
+		nodeID = hostname
+	}
+
+	lease := time.Duration(config.LeaseSeconds) * time.Second
+	if lease <= 0 {
+		lease = defaultLease
+		if runInterval > 0 {
+			// the leader keeps the lease if it runs again before it expires
+			lease = 2 * runInterval
+		}
+	}
+
+	switch config.Backend {
+	case "":
+		return nil, nil
+	case "leasefile":
+		if config.LeaseFile == "" {
+			return nil, fmt.Errorf("Cluster backend leasefile needs a lease file")
+		}
+		if config.LeaseSeconds <= 0 && runInterval == 0 {
+			log.Warnf("Cluster lease %s defaults to %s in one-shot mode; set leaseseconds to more than the interval of the runs, otherwise leadership changes between nodes", config.LeaseFile, lease)
+		}
+		return NewLeaseFile(config.LeaseFile, nodeID, lease), nil
+	default:
+		return nil, fmt.Errorf("Unknown cluster backend %s", config.Backend)
+	}
+}
@@ -0,0 +1,97 @@
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"felix-hartmond.de/projects/certbutler/common"
+)
+
+const leaseLockTimeout = 30
+
+// LeaseFile elects the leader with a lease stored in a file on storage shared by all nodes
+// The node holding an unexpired lease is the leader; updates of the lease are serialized with a lock file.
+type LeaseFile struct {
+	filename string
+	nodeID   string
+	duration time.Duration
+}
+
+type lease struct {
+	Holder  string
+	Expires time.Time
+}
+
+// NewLeaseFile creates a lease file elector for this node
+func NewLeaseFile(filename, nodeID string, duration time.Duration) *LeaseFile {
+	return &LeaseFile{filename: filename, nodeID: nodeID, duration: duration}
+}
+
+// Acquire takes the lease if it is expired or already held by this node and extends it
+func (l *LeaseFile) Acquire(ctx context.Context) (bool, error) {
+	unlock, err := common.LockFile(ctx, l.filename+".lock", common.LockConfiguration{TimeoutSeconds: leaseLockTimeout})
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+
+	current, err := l.read()
+	if err != nil {
+		return false, err
+	}
+
+	now := time.Now()
+	if current.Holder != l.nodeID && now.Before(current.Expires) {
+		return false, nil
+	}
+	if current.Holder != l.nodeID {
+		log.Infof("Node %s takes over the lease %s from %q", l.nodeID, l.filename, current.Holder)
+	}
+
+	return true, l.write(lease{Holder: l.nodeID, Expires: now.Add(l.duration)})
+}
+
+// Release expires the lease if it is held by this node
+func (l *LeaseFile) Release() error {
+	unlock, err := common.LockFile(context.Background(), l.filename+".lock", common.LockConfiguration{TimeoutSeconds: leaseLockTimeout})
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	current, err := l.read()
+	if err != nil || current.Holder != l.nodeID {
+		return err
+	}
+	log.Infof("Node %s releases the lease %s", l.nodeID, l.filename)
+	return l.write(lease{Holder: l.nodeID})
+}
+
+func (l *LeaseFile) read() (lease, error) {
+	var current lease
+	data, err := ioutil.ReadFile(l.filename)
+	if os.IsNotExist(err) {
+		return current, nil
+	}
+	if err != nil {
+		return current, err
+	}
+	if err = json.Unmarshal(data, &current); err != nil {
+		return current, fmt.Errorf("Lease file %s is corrupt: %v", l.filename, err)
+	}
+	return current, nil
+}
+
+func (l *LeaseFile) write(current lease) error {
+	data, err := json.Marshal(current)
+	if err != nil {
+		return err
+	}
+	return common.WriteFileAtomic(l.filename, data, common.FilePermissions{})
+}
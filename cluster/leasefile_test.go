@@ -0,0 +1,122 @@
+package cluster
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"felix-hartmond.de/projects/certbutler/common"
+)
+
+func newTestLeaseFile(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "certbutler-lease")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return filepath.Join(dir, "example.com.lease")
+}
+
+func acquire(t *testing.T, elector Elector) bool {
+	leader, err := elector.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("Acquire failed: %v", err)
+	}
+	return leader
+}
+
+func TestLeaseFileTakeOver(t *testing.T) {
+	filename := newTestLeaseFile(t)
+	node1 := NewLeaseFile(filename, "node1", time.Hour)
+	node2 := NewLeaseFile(filename, "node2", time.Hour)
+
+	if !acquire(t, node1) {
+		t.Fatal("node1 did not get the free lease")
+	}
+	if acquire(t, node2) {
+		t.Fatal("node2 took over the lease held by node1")
+	}
+	if !acquire(t, node1) {
+		t.Fatal("node1 could not extend its own lease")
+	}
+}
+
+func TestLeaseFileExpiry(t *testing.T) {
+	filename := newTestLeaseFile(t)
+	node1 := NewLeaseFile(filename, "node1", 100*time.Millisecond)
+	node2 := NewLeaseFile(filename, "node2", time.Hour)
+
+	if !acquire(t, node1) {
+		t.Fatal("node1 did not get the free lease")
+	}
+	time.Sleep(200 * time.Millisecond)
+	if !acquire(t, node2) {
+		t.Fatal("node2 did not take over the expired lease")
+	}
+	if acquire(t, node1) {
+		t.Fatal("node1 got the lease back while node2 holds it")
+	}
+}
+
+func TestLeaseFileRelease(t *testing.T) {
+	filename := newTestLeaseFile(t)
+	node1 := NewLeaseFile(filename, "node1", time.Hour)
+	node2 := NewLeaseFile(filename, "node2", time.Hour)
+
+	if !acquire(t, node1) {
+		t.Fatal("node1 did not get the free lease")
+	}
+	// releasing a lease held by another node does nothing
+	if err := node2.Release(); err != nil {
+		t.Fatalf("Release failed: %v", err)
+	}
+	if acquire(t, node2) {
+		t.Fatal("node2 took over the lease after releasing a lease it did not hold")
+	}
+
+	if err := node1.Release(); err != nil {
+		t.Fatalf("Release failed: %v", err)
+	}
+	if !acquire(t, node2) {
+		t.Fatal("node2 did not take over the released lease")
+	}
+}
+
+func TestLeaseFileCorrupt(t *testing.T) {
+	filename := newTestLeaseFile(t)
+	if err := ioutil.WriteFile(filename, []byte("{not json"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewLeaseFile(filename, "node1", time.Hour).Acquire(context.Background()); err == nil {
+		t.Fatal("Acquire succeeded on a corrupt lease file")
+	}
+}
+
+func TestNewLeaseDuration(t *testing.T) {
+	filename := newTestLeaseFile(t)
+	config := common.ClusterConfiguration{Backend: "leasefile", LeaseFile: filename, NodeID: "node1"}
+
+	tests := []struct {
+		leaseSeconds int
+		runInterval  time.Duration
+		want         time.Duration
+	}{
+		{0, 0, defaultLease},
+		{0, 24 * time.Hour, 48 * time.Hour},
+		{600, 24 * time.Hour, 10 * time.Minute},
+	}
+	for _, test := range tests {
+		config.LeaseSeconds = test.leaseSeconds
+		elector, err := New(config, test.runInterval)
+		if err != nil {
+			t.Fatalf("New failed: %v", err)
+		}
+		if got := elector.(*LeaseFile).duration; got != test.want {
+			t.Errorf("Lease for leaseseconds %d and interval %s is %s, want %s", test.leaseSeconds, test.runInterval, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package common
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	pemTypeKeyRSA = "RSA PRIVATE KEY"
+)
+
+// Bundle holds all certificates, keys and other pem blocks found in a file, in the order of the file
+type Bundle struct {
+	Certificates []*x509.Certificate
+	Keys         []crypto.PrivateKey
+	Other        []*pem.Block // blocks which are no parsable certificates or unencrypted keys (e.g. encrypted keys, EC parameters)
+}
+
+// LoadBundle reads and parses a pem file
+func LoadBundle(filename string) (*Bundle, error) {
+	pemBytes, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return ParseBundle(pemBytes)
+}
+
+// ParseBundle parses all pem blocks from data. Text between the blocks (e.g. openssl's "Bag Attributes") is ignored.
+// Certificates and keys which cannot be parsed are logged and kept in Other.
+func ParseBundle(pemBytes []byte) (*Bundle, error) {
+	bundle := &Bundle{}
+	for {
+		var block *pem.Block
+		block, pemBytes = pem.Decode(pemBytes)
+		if block == nil {
+			break
+		}
+
+		switch block.Type {
+		case pemTypeCert:
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				// files may be mixed by other tools => keep the block, but continue with the rest of the file
+				log.Warnf("Skipping unparsable certificate: %v", err)
+				bundle.Other = append(bundle.Other, block)
+				continue
+			}
+			bundle.Certificates = append(bundle.Certificates, cert)
+		case pemTypeKey, pemTypeKeyRSA, pemTypeKeyPKCS8:
+			key, err := parsePrivateKey(block)
+			if err != nil {
+				log.Warnf("Skipping unparsable private key: %v", err)
+				bundle.Other = append(bundle.Other, block)
+				continue
+			}
+			bundle.Keys = append(bundle.Keys, key)
+		default:
+			bundle.Other = append(bundle.Other, block)
+		}
+	}
+
+	if len(bundle.Certificates) == 0 && len(bundle.Keys) == 0 && len(bundle.Other) == 0 {
+		return nil, fmt.Errorf("No pem blocks found")
+	}
+	return bundle, nil
+}
+
+// parsePrivateKey parses an unencrypted EC, RSA or PKCS#8 key block
+func parsePrivateKey(block *pem.Block) (crypto.PrivateKey, error) {
+	switch block.Type {
+	case pemTypeKey:
+		return x509.ParseECPrivateKey(block.Bytes)
+	case pemTypeKeyRSA:
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	default:
+		return x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+}
+
+// Leaf returns the end entity certificate of the bundle
+// This is the certificate matching the key of the bundle, or the first non-CA certificate, or the first certificate.
+func (bundle *Bundle) Leaf() (*x509.Certificate, error) {
+	if len(bundle.Certificates) == 0 {
+		return nil, fmt.Errorf("No certificate found")
+	}
+
+	for _, key := range bundle.Keys {
+		for _, cert := range bundle.Certificates {
+			if keyMatchesCertificate(key, cert) {
+				return cert, nil
+			}
+		}
+	}
+	for _, cert := range bundle.Certificates {
+		if !cert.IsCA {
+			return cert, nil
+		}
+	}
+	return bundle.Certificates[0], nil
+}
+
+// Issuer returns the certificate of the bundle which issued cert, or nil if the bundle does not contain it
+func (bundle *Bundle) Issuer(cert *x509.Certificate) *x509.Certificate {
+	for _, candidate := range bundle.Certificates {
+		if candidate == cert || !bytes.Equal(candidate.RawSubject, cert.RawIssuer) {
+			continue
+		}
+		if cert.CheckSignatureFrom(candidate) == nil {
+			return candidate
+		}
+	}
+	return nil
+}
+
+// Chain returns the leaf followed by its issuers as far as they are contained in the bundle
+func (bundle *Bundle) Chain() ([]*x509.Certificate, error) {
+	leaf, err := bundle.Leaf()
+	if err != nil {
+		return nil, err
+	}
+
+	chain := []*x509.Certificate{leaf}
+	for cert := bundle.Issuer(leaf); cert != nil && len(chain) <= len(bundle.Certificates); cert = bundle.Issuer(cert) {
+		if cert.Equal(chain[len(chain)-1]) {
+			// self-signed root
+			break
+		}
+		chain = append(chain, cert)
+	}
+	return chain, nil
+}
+
+// ECKey returns the first ECDSA key of the bundle
+func (bundle *Bundle) ECKey() (*ecdsa.PrivateKey, error) {
+	for _, key := range bundle.Keys {
+		if ecKey, ok := key.(*ecdsa.PrivateKey); ok {
+			return ecKey, nil
+		}
+	}
+	return nil, fmt.Errorf("No ECDSA key found")
+}
+
+func keyMatchesCertificate(key crypto.PrivateKey, cert *x509.Certificate) bool {
+	switch privateKey := key.(type) {
+	case *ecdsa.PrivateKey:
+		return privateKey.PublicKey.Equal(cert.PublicKey)
+	case *rsa.PrivateKey:
+		return privateKey.PublicKey.Equal(cert.PublicKey)
+	case ed25519.PrivateKey:
+		return privateKey.Public().(ed25519.PublicKey).Equal(cert.PublicKey)
+	}
+	return false
+}
@@ -0,0 +1,270 @@
+package common
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultArchiveDirectory = "archive"
+	defaultRetentionCount   = 5
+	archiveTimeFormat       = "20060102T150405.000000000Z"
+	archiveTimeFormatLegacy = "20060102T150405Z" // archives written before nanoseconds were added
+	defaultFileMode         = 0600
+)
+
+// FileOptions bundles how a file is written
+type FileOptions struct {
+	Permissions   FilePermissions
+	Archive       ArchiveConfiguration
+	KeyFormat     string                     // format of contained keys; only used for PEM files
+	KeyEncryption KeyEncryptionConfiguration // encryption of contained keys; only used for PEM files
+	NoArchive     bool                       // replace the file without archiving it, e.g. if it holds a plaintext key which is being encrypted
+}
+
+// SaveToFile archives the current version of filename and atomically replaces it with data
+func SaveToFile(filename string, data []byte, options FileOptions) error {
+	if !options.NoArchive {
+		if err := ArchiveFile(filename, options.Archive); err != nil {
+			return err
+		}
+	}
+	return WriteFileAtomic(filename, data, options.Permissions)
+}
+
+// WriteFileAtomic writes data to a temporary file in the target directory, syncs it and renames it into place.
+// Readers of filename therefore either see the old or the new content but never a partially written file.
+// Mode and ownership are applied to the temporary file, so the file never exists with other permissions.
+func WriteFileAtomic(filename string, data []byte, permissions FilePermissions) error {
+	perm, uid, gid, err := permissions.resolve()
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(filename)
+	tmpFile, err := ioutil.TempFile(dir, "."+filepath.Base(filename)+".tmp")
+	if err != nil {
+		return err
+	}
+	tmpName := tmpFile.Name()
+	defer os.Remove(tmpName) // no-op after a successful rename
+
+	if _, err = tmpFile.Write(data); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err = tmpFile.Chmod(perm); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if uid != -1 || gid != -1 {
+		if err = tmpFile.Chown(uid, gid); err != nil {
+			tmpFile.Close()
+			return err
+		}
+	}
+	if err = tmpFile.Sync(); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err = tmpFile.Close(); err != nil {
+		return err
+	}
+
+	if err = os.Rename(tmpName, filename); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// ArchiveFile copies the current version of filename into the archive directory and prunes old generations according to the retention policy
+func ArchiveFile(filename string, archive ArchiveConfiguration) error {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			// nothing to archive
+			return nil
+		}
+		return err
+	}
+	info, err := os.Stat(filename)
+	if err != nil {
+		return err
+	}
+
+	archiveDir := archive.Directory
+	if archiveDir == "" {
+		archiveDir = filepath.Join(filepath.Dir(filename), defaultArchiveDirectory)
+	}
+	if err = os.MkdirAll(archiveDir, 0700); err != nil {
+		return err
+	}
+
+	name, extension := splitExtension(filepath.Base(filename))
+	for timestamp := info.ModTime().UTC(); ; timestamp = timestamp.Add(time.Nanosecond) {
+		// file systems with coarse timestamps may give different versions the same modification time
+		archiveName := filepath.Join(archiveDir, fmt.Sprintf("%s-%s%s", name, timestamp.Format(archiveTimeFormat), extension))
+		archived, err := ioutil.ReadFile(archiveName)
+		if os.IsNotExist(err) {
+			if err = WriteFileAtomic(archiveName, data, FilePermissions{}); err != nil {
+				return err
+			}
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if bytes.Equal(archived, data) {
+			// this version is already archived
+			break
+		}
+	}
+
+	return pruneArchive(archiveDir, name, extension, archive)
+}
+
+// pruneArchive removes all generations of a file which are not covered by the retention policy
+func pruneArchive(archiveDir, name, extension string, archive ArchiveConfiguration) error {
+	retentionCount := archive.RetentionCount
+	if retentionCount == 0 && archive.RetentionDays == 0 {
+		retentionCount = defaultRetentionCount
+	}
+
+	entries, err := ioutil.ReadDir(archiveDir)
+	if err != nil {
+		return err
+	}
+
+	type generation struct {
+		filename  string
+		timestamp time.Time
+	}
+	generations := []generation{}
+	for _, entry := range entries {
+		entryName := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(entryName, name+"-") || !strings.HasSuffix(entryName, extension) {
+			continue
+		}
+		timestampString := strings.TrimSuffix(strings.TrimPrefix(entryName, name+"-"), extension)
+		timestamp, err := time.Parse(archiveTimeFormat, timestampString)
+		if err != nil {
+			timestamp, err = time.Parse(archiveTimeFormatLegacy, timestampString)
+		}
+		if err != nil {
+			// not written by ArchiveFile
+			continue
+		}
+		generations = append(generations, generation{filepath.Join(archiveDir, entryName), timestamp})
+	}
+
+	// newest first
+	sort.Slice(generations, func(i, j int) bool {
+		return generations[i].timestamp.After(generations[j].timestamp)
+	})
+
+	maxAge := time.Duration(archive.RetentionDays) * 24 * time.Hour
+	for i, generation := range generations {
+		expiredByCount := retentionCount > 0 && i >= retentionCount
+		expiredByAge := archive.RetentionDays > 0 && time.Since(generation.timestamp) > maxAge
+		if expiredByCount || expiredByAge {
+			if err := SecureRemove(generation.filename); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// SecureRemove overwrites a file with random data before removing it, so old private keys are not left on disk
+func SecureRemove(filename string) error {
+	file, err := os.OpenFile(filename, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	if _, err = io.CopyN(file, rand.Reader, info.Size()); err != nil {
+		file.Close()
+		return err
+	}
+	if err = file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err = file.Close(); err != nil {
+		return err
+	}
+	return os.Remove(filename)
+}
+
+// resolve converts the configured permissions to a file mode and numeric ids. Ids are -1 if they should not be changed.
+func (permissions FilePermissions) resolve() (os.FileMode, int, int, error) {
+	mode := os.FileMode(defaultFileMode)
+	if permissions.Mode != "" {
+		parsed, err := strconv.ParseUint(permissions.Mode, 8, 32)
+		if err != nil || parsed > 0777 {
+			return 0, 0, 0, fmt.Errorf("Invalid file mode %q", permissions.Mode)
+		}
+		mode = os.FileMode(parsed)
+	}
+
+	uid, gid := -1, -1
+	if permissions.Owner != "" {
+		if id, err := strconv.Atoi(permissions.Owner); err == nil {
+			uid = id
+		} else {
+			owner, err := user.Lookup(permissions.Owner)
+			if err != nil {
+				return 0, 0, 0, err
+			}
+			if uid, err = strconv.Atoi(owner.Uid); err != nil {
+				return 0, 0, 0, fmt.Errorf("User %s has no numeric uid", permissions.Owner)
+			}
+		}
+	}
+	if permissions.Group != "" {
+		if id, err := strconv.Atoi(permissions.Group); err == nil {
+			gid = id
+		} else {
+			group, err := user.LookupGroup(permissions.Group)
+			if err != nil {
+				return 0, 0, 0, err
+			}
+			if gid, err = strconv.Atoi(group.Gid); err != nil {
+				return 0, 0, 0, fmt.Errorf("Group %s has no numeric gid", permissions.Group)
+			}
+		}
+	}
+	return mode, uid, gid, nil
+}
+
+func splitExtension(filename string) (string, string) {
+	if offset := strings.LastIndex(filename, "."); offset > 0 {
+		return filename[:offset], filename[offset:]
+	}
+	return filename, ""
+}
+
+func syncDir(dir string) error {
+	dirFile, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer dirFile.Close()
+	// syncing directories is not supported on every platform, the rename already happened anyway
+	dirFile.Sync()
+	return nil
+}
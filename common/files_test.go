@@ -0,0 +1,76 @@
+package common
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestArchiveFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certbutler-archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	filename := filepath.Join(dir, "cert.pem")
+	archiveDir := filepath.Join(dir, defaultArchiveDirectory)
+	modTime := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	// versions written within the same second get the same modification time on coarse file systems
+	archive := func(content string) {
+		if err := ioutil.WriteFile(filename, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(filename, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+		if err := ArchiveFile(filename, ArchiveConfiguration{RetentionCount: 3}); err != nil {
+			t.Fatalf("ArchiveFile failed: %v", err)
+		}
+	}
+	readArchive := func() []string {
+		entries, err := ioutil.ReadDir(archiveDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents := []string{}
+		for _, entry := range entries {
+			data, err := ioutil.ReadFile(filepath.Join(archiveDir, entry.Name()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			contents = append(contents, string(data))
+		}
+		sort.Strings(contents)
+		return contents
+	}
+
+	// an archive written by older versions is pruned like the others
+	if err := os.MkdirAll(archiveDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(archiveDir, "cert-20200101T000000Z.pem"), []byte("legacy"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	archive("first")
+	archive("second")
+	if contents := readArchive(); len(contents) != 3 || contents[0] != "first" || contents[1] != "legacy" || contents[2] != "second" {
+		t.Errorf("Archive contains %v, want first, legacy and second", contents)
+	}
+
+	// archiving the same version again does not add a copy
+	archive("second")
+	if contents := readArchive(); len(contents) != 3 {
+		t.Errorf("Archive contains %v after archiving a version twice", contents)
+	}
+
+	// the oldest generation is removed first
+	archive("third")
+	if contents := readArchive(); len(contents) != 3 || contents[0] != "first" || contents[1] != "second" || contents[2] != "third" {
+		t.Errorf("Archive contains %v, want first, second and third", contents)
+	}
+}
@@ -0,0 +1,126 @@
+package common
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// writeAdditionalFormats writes the certificates and key in the configured non-PEM formats
+func writeAdditionalFormats(certs [][]byte, key *ecdsa.PrivateKey, filesConfig FilesConfiguration, certOptions, keyOptions FileOptions) error {
+	if filesConfig.DERLeafFile != "" {
+		err := SaveToFile(filesConfig.DERLeafFile, certs[0], certOptions)
+		if err != nil {
+			return err
+		}
+	}
+
+	if filesConfig.DERChainFile != "" && len(certs) < 2 {
+		if err := removeEmptyLayout(filesConfig.DERChainFile, certOptions); err != nil {
+			return err
+		}
+	} else if filesConfig.DERChainFile != "" {
+		err := SaveToFile(filesConfig.DERChainFile, bytes.Join(certs[1:], nil), certOptions)
+		if err != nil {
+			return err
+		}
+	}
+
+	if filesConfig.PKCS12File != "" {
+		pfxData, err := EncodePKCS12(certs, key, filesConfig.PKCS12Password, filesConfig.PKCS12AllowEmptyPassword)
+		if err != nil {
+			return err
+		}
+		err = SaveToFile(filesConfig.PKCS12File, pfxData, keyOptions)
+		if err != nil {
+			return err
+		}
+	}
+
+	if filesConfig.JKSFile != "" {
+		jksData, err := EncodeJKS(certs, key, filesConfig.JKSAlias, filesConfig.JKSStorePassword, filesConfig.JKSKeyPassword, filesConfig.JKSAllowEmptyPassword)
+		if err != nil {
+			return err
+		}
+		err = SaveToFile(filesConfig.JKSFile, jksData, keyOptions)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// LoadAdditionalFormats reads certificates and key back from the PKCS#12 file or, without key, from the DER files
+// It is used instead of the PEM files if they are not written (SkipPEM).
+func LoadAdditionalFormats(filesConfig FilesConfiguration) (*Bundle, error) {
+	if filesConfig.PKCS12File != "" {
+		pfxData, err := ioutil.ReadFile(filesConfig.PKCS12File)
+		if err != nil {
+			return nil, err
+		}
+		password, err := filesConfig.PKCS12Password.Read()
+		if err != nil {
+			return nil, fmt.Errorf("Reading PKCS#12 password failed: %v", err)
+		}
+		key, cert, caCerts, err := pkcs12.DecodeChain(pfxData, password)
+		if err != nil {
+			return nil, fmt.Errorf("Decoding %s failed: %v", filesConfig.PKCS12File, err)
+		}
+		return &Bundle{Certificates: append([]*x509.Certificate{cert}, caCerts...), Keys: []crypto.PrivateKey{key}}, nil
+	}
+
+	if filesConfig.DERLeafFile == "" {
+		return nil, fmt.Errorf("Skipping PEM files needs a PKCS#12 or DER leaf file to keep the certificate")
+	}
+	der, err := ioutil.ReadFile(filesConfig.DERLeafFile)
+	if err != nil {
+		return nil, err
+	}
+	if filesConfig.DERChainFile != "" {
+		chainDER, err := ioutil.ReadFile(filesConfig.DERChainFile)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		der = append(der, chainDER...)
+	}
+	certs, err := x509.ParseCertificates(der)
+	if err != nil {
+		return nil, fmt.Errorf("Parsing %s failed: %v", filesConfig.DERLeafFile, err)
+	}
+	return &Bundle{Certificates: certs}, nil
+}
+
+// EncodePKCS12 bundles key, certificate and chain in a password protected PKCS#12 file
+// An empty password is only accepted if allowEmptyPassword is set, as the bundle contains the private key.
+func EncodePKCS12(certs [][]byte, key *ecdsa.PrivateKey, passwordSecret Secret, allowEmptyPassword bool) ([]byte, error) {
+	password, err := passwordSecret.Read()
+	if err != nil {
+		return nil, fmt.Errorf("Reading PKCS#12 password failed: %v", err)
+	}
+	if password == "" {
+		if !allowEmptyPassword {
+			return nil, fmt.Errorf("PKCS#12 password is empty")
+		}
+		log.Warn("Writing PKCS#12 bundle with an empty password - the private key is not protected")
+	}
+
+	parsed := []*x509.Certificate{}
+	for _, der := range certs {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, err
+		}
+		parsed = append(parsed, cert)
+	}
+
+	return pkcs12.Encode(rand.Reader, key, parsed[0], parsed[1:], password)
+}
@@ -0,0 +1,47 @@
+package common
+
+import (
+	"crypto/ecdsa"
+	"testing"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+func TestEncodePKCS12(t *testing.T) {
+	certs, key := newTestChain(t)
+	tests := []struct {
+		name       string
+		password   string
+		allowEmpty bool
+		wantErr    bool
+	}{
+		{"password", "secret", false, false},
+		{"empty password", "", false, true},
+		{"allowed empty password", "", true, false},
+	}
+	for _, test := range tests {
+		pfxData, err := EncodePKCS12(certs, key, newTestSecret(t, "CERTBUTLER_TEST_P12_PASSWORD", test.password), test.allowEmpty)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%s: EncodePKCS12 succeeded", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: EncodePKCS12 failed: %v", test.name, err)
+			continue
+		}
+
+		decodedKey, leaf, chain, err := pkcs12.DecodeChain(pfxData, test.password)
+		if err != nil {
+			t.Errorf("%s: decoding the bundle failed: %v", test.name, err)
+			continue
+		}
+		if ecKey, ok := decodedKey.(*ecdsa.PrivateKey); !ok || ecKey.D.Cmp(key.D) != 0 {
+			t.Errorf("%s: bundle contains a different key", test.name)
+		}
+		if string(leaf.Raw) != string(certs[0]) || len(chain) != 1 || string(chain[0].Raw) != string(certs[1]) {
+			t.Errorf("%s: bundle contains a different chain", test.name)
+		}
+	}
+}
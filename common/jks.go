@@ -0,0 +1,161 @@
+package common
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	jksMagic           = 0xfeedfeed
+	jksVersion         = 2
+	jksTagPrivateKey   = 1
+	jksDefaultAlias    = "certbutler"
+	jksIntegrityMarker = "Mighty Aphrodite"
+)
+
+// oidJKSKeyProtector identifies the proprietary key protection algorithm of the sun JKS implementation
+var oidJKSKeyProtector = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 42, 2, 17, 1, 1}
+
+type jksEncryptedPrivateKeyInfo struct {
+	Algorithm     pkix.AlgorithmIdentifier
+	EncryptedData []byte
+}
+
+// EncodeJKS builds a java keystore containing the key and its certificate chain as a single private key entry
+// Empty passwords are only accepted if allowEmptyPassword is set, as the keystore contains the private key.
+func EncodeJKS(certs [][]byte, key *ecdsa.PrivateKey, alias string, storePasswordSecret, keyPasswordSecret Secret, allowEmptyPassword bool) ([]byte, error) {
+	storePassword, err := storePasswordSecret.Read()
+	if err != nil {
+		return nil, fmt.Errorf("Reading JKS store password failed: %v", err)
+	}
+	keyPassword := storePassword
+	if keyPasswordSecret.Configured() {
+		keyPassword, err = keyPasswordSecret.Read()
+		if err != nil {
+			return nil, fmt.Errorf("Reading JKS key password failed: %v", err)
+		}
+	}
+	if storePassword == "" || keyPassword == "" {
+		if !allowEmptyPassword {
+			return nil, fmt.Errorf("JKS password is empty")
+		}
+		log.Warn("Writing java keystore with an empty password - the private key is not protected")
+	}
+	if alias == "" {
+		alias = jksDefaultAlias
+	}
+
+	protectedKey, err := jksProtectKey(key, keyPassword)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, uint32(jksMagic))
+	binary.Write(&buf, binary.BigEndian, uint32(jksVersion))
+	binary.Write(&buf, binary.BigEndian, uint32(1)) // number of entries
+
+	binary.Write(&buf, binary.BigEndian, uint32(jksTagPrivateKey))
+	if err = jksWriteUTF(&buf, strings.ToLower(alias)); err != nil {
+		return nil, err
+	}
+	binary.Write(&buf, binary.BigEndian, time.Now().UnixNano()/int64(time.Millisecond))
+	binary.Write(&buf, binary.BigEndian, uint32(len(protectedKey)))
+	buf.Write(protectedKey)
+
+	binary.Write(&buf, binary.BigEndian, uint32(len(certs)))
+	for _, cert := range certs {
+		if err = jksWriteUTF(&buf, "X.509"); err != nil {
+			return nil, err
+		}
+		binary.Write(&buf, binary.BigEndian, uint32(len(cert)))
+		buf.Write(cert)
+	}
+
+	// keyed integrity digest over the whole store
+	digest := sha1.New()
+	digest.Write(jksPasswordBytes(storePassword))
+	digest.Write([]byte(jksIntegrityMarker))
+	digest.Write(buf.Bytes())
+	buf.Write(digest.Sum(nil))
+
+	return buf.Bytes(), nil
+}
+
+// jksProtectKey encrypts the PKCS#8 encoded key with the JKS key protector (salt | key xor sha1 keystream | sha1 check)
+func jksProtectKey(key *ecdsa.PrivateKey, password string) ([]byte, error) {
+	plainKey, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	passwordBytes := jksPasswordBytes(password)
+
+	salt := make([]byte, sha1.Size)
+	if _, err = rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	keystream := []byte{}
+	digest := salt
+	for len(keystream) < len(plainKey) {
+		hash := sha1.New()
+		hash.Write(passwordBytes)
+		hash.Write(digest)
+		digest = hash.Sum(nil)
+		keystream = append(keystream, digest...)
+	}
+
+	encrypted := make([]byte, len(plainKey))
+	for i := range plainKey {
+		encrypted[i] = plainKey[i] ^ keystream[i]
+	}
+
+	check := sha1.New()
+	check.Write(passwordBytes)
+	check.Write(plainKey)
+
+	protected := append(append(salt, encrypted...), check.Sum(nil)...)
+	return asn1.Marshal(jksEncryptedPrivateKeyInfo{
+		Algorithm: pkix.AlgorithmIdentifier{
+			Algorithm:  oidJKSKeyProtector,
+			Parameters: asn1.NullRawValue,
+		},
+		EncryptedData: protected,
+	})
+}
+
+// jksPasswordBytes encodes a password as UTF-16 big endian like java does for JKS
+func jksPasswordBytes(password string) []byte {
+	passwordBytes := []byte{}
+	for _, char := range utf16.Encode([]rune(password)) {
+		passwordBytes = append(passwordBytes, byte(char>>8), byte(char))
+	}
+	return passwordBytes
+}
+
+// jksWriteUTF writes a string in the format of java's DataOutput.writeUTF
+func jksWriteUTF(buf *bytes.Buffer, value string) error {
+	if len(value) > 0xffff {
+		return fmt.Errorf("String too long for JKS: %s", value)
+	}
+	for _, char := range value {
+		if char == 0 || char > 0x7f {
+			return fmt.Errorf("Only ASCII characters are supported in JKS aliases: %s", value)
+		}
+	}
+	binary.Write(buf, binary.BigEndian, uint16(len(value)))
+	buf.WriteString(value)
+	return nil
+}
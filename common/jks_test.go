@@ -0,0 +1,235 @@
+package common
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"fmt"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// newTestChain creates a certificate signed by a test CA and returns leaf and CA certificate with the key of the leaf
+func newTestChain(t *testing.T) ([][]byte, *ecdsa.PrivateKey) {
+	caKey, key := newTestKey(t), newTestKey(t)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "example.com"},
+		DNSNames:     []string{"example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, caTemplate, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return [][]byte{der, caDER}, key
+}
+
+// decodeTestJKS reads a keystore with one private key entry as written by EncodeJKS and checks integrity digest and key protection
+func decodeTestJKS(store []byte, storePassword, keyPassword string) (string, *ecdsa.PrivateKey, [][]byte, error) {
+	if len(store) < sha1.Size {
+		return "", nil, nil, fmt.Errorf("Keystore too short")
+	}
+	data, storedDigest := store[:len(store)-sha1.Size], store[len(store)-sha1.Size:]
+	digest := sha1.New()
+	digest.Write(jksPasswordBytes(storePassword))
+	digest.Write([]byte(jksIntegrityMarker))
+	digest.Write(data)
+	if !bytes.Equal(digest.Sum(nil), storedDigest) {
+		return "", nil, nil, fmt.Errorf("Keystore integrity check failed")
+	}
+
+	reader := bytes.NewReader(data)
+	var header struct{ Magic, Version, Entries, Tag uint32 }
+	if err := binary.Read(reader, binary.BigEndian, &header); err != nil {
+		return "", nil, nil, err
+	}
+	if header.Magic != jksMagic || header.Version != jksVersion || header.Entries != 1 || header.Tag != jksTagPrivateKey {
+		return "", nil, nil, fmt.Errorf("Unexpected keystore header %+v", header)
+	}
+	readBytes := func(lengthSize int) ([]byte, error) {
+		var length uint32
+		if lengthSize == 2 {
+			var short uint16
+			if err := binary.Read(reader, binary.BigEndian, &short); err != nil {
+				return nil, err
+			}
+			length = uint32(short)
+		} else if err := binary.Read(reader, binary.BigEndian, &length); err != nil {
+			return nil, err
+		}
+		value := make([]byte, length)
+		_, err := reader.Read(value)
+		return value, err
+	}
+
+	alias, err := readBytes(2)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	var timestamp int64
+	if err = binary.Read(reader, binary.BigEndian, &timestamp); err != nil {
+		return "", nil, nil, err
+	}
+	protectedKey, err := readBytes(4)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	var info jksEncryptedPrivateKeyInfo
+	if _, err = asn1.Unmarshal(protectedKey, &info); err != nil {
+		return "", nil, nil, err
+	}
+	if !info.Algorithm.Algorithm.Equal(oidJKSKeyProtector) || len(info.EncryptedData) < 2*sha1.Size {
+		return "", nil, nil, fmt.Errorf("Unexpected key protection")
+	}
+
+	// salt | key xor sha1 keystream | sha1 check
+	passwordBytes := jksPasswordBytes(keyPassword)
+	salt := info.EncryptedData[:sha1.Size]
+	encrypted := info.EncryptedData[sha1.Size : len(info.EncryptedData)-sha1.Size]
+	plainKey := make([]byte, len(encrypted))
+	keystream := []byte{}
+	for block := salt; len(keystream) < len(encrypted); {
+		hash := sha1.New()
+		hash.Write(passwordBytes)
+		hash.Write(block)
+		block = hash.Sum(nil)
+		keystream = append(keystream, block...)
+	}
+	for i := range encrypted {
+		plainKey[i] = encrypted[i] ^ keystream[i]
+	}
+	check := sha1.New()
+	check.Write(passwordBytes)
+	check.Write(plainKey)
+	if !bytes.Equal(check.Sum(nil), info.EncryptedData[len(info.EncryptedData)-sha1.Size:]) {
+		return "", nil, nil, fmt.Errorf("Key password is wrong")
+	}
+	parsedKey, err := x509.ParsePKCS8PrivateKey(plainKey)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	key, ok := parsedKey.(*ecdsa.PrivateKey)
+	if !ok {
+		return "", nil, nil, fmt.Errorf("Unexpected key type %T", parsedKey)
+	}
+
+	var count uint32
+	if err = binary.Read(reader, binary.BigEndian, &count); err != nil {
+		return "", nil, nil, err
+	}
+	certs := [][]byte{}
+	for i := uint32(0); i < count; i++ {
+		certType, err := readBytes(2)
+		if err != nil {
+			return "", nil, nil, err
+		}
+		if string(certType) != "X.509" {
+			return "", nil, nil, fmt.Errorf("Unexpected certificate type %s", certType)
+		}
+		cert, err := readBytes(4)
+		if err != nil {
+			return "", nil, nil, err
+		}
+		certs = append(certs, cert)
+	}
+	if reader.Len() != 0 {
+		return "", nil, nil, fmt.Errorf("Trailing data in keystore")
+	}
+	return string(alias), key, certs, nil
+}
+
+func TestEncodeJKS(t *testing.T) {
+	certs, key := newTestChain(t)
+	tests := []struct {
+		name          string
+		alias         string
+		storePassword string
+		keyPassword   string // empty to use the store password
+		readStore     string
+		readKey       string
+		wantAlias     string
+		allowEmpty    bool
+		wantErr       bool
+	}{
+		{"default alias", "", "changeit", "", "changeit", "changeit", jksDefaultAlias, false, false},
+		{"alias is lower case", "Example.COM", "changeit", "", "changeit", "changeit", "example.com", false, false},
+		{"separate key password", "", "changeit", "keypass", "changeit", "keypass", jksDefaultAlias, false, false},
+		{"non ascii password", "", "pässwörd€", "", "pässwörd€", "pässwörd€", jksDefaultAlias, false, false},
+		{"allowed empty password", "", "", "", "", "", jksDefaultAlias, true, false},
+		{"wrong store password", "", "changeit", "", "wrong", "changeit", "", false, true},
+		{"wrong key password", "", "changeit", "keypass", "changeit", "changeit", "", false, true},
+	}
+	for _, test := range tests {
+		keyPassword := Secret{}
+		if test.keyPassword != "" {
+			keyPassword = newTestSecret(t, "CERTBUTLER_TEST_JKS_KEY_PASSWORD", test.keyPassword)
+		}
+		store, err := EncodeJKS(certs, key, test.alias, newTestSecret(t, "CERTBUTLER_TEST_JKS_STORE_PASSWORD", test.storePassword), keyPassword, test.allowEmpty)
+		if err != nil {
+			t.Fatalf("%s: EncodeJKS failed: %v", test.name, err)
+		}
+
+		alias, decodedKey, decodedCerts, err := decodeTestJKS(store, test.readStore, test.readKey)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%s: keystore could be read", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: reading keystore failed: %v", test.name, err)
+			continue
+		}
+		if alias != test.wantAlias {
+			t.Errorf("%s: alias is %s, want %s", test.name, alias, test.wantAlias)
+		}
+		if decodedKey.D.Cmp(key.D) != 0 {
+			t.Errorf("%s: keystore contains a different key", test.name)
+		}
+		if len(decodedCerts) != len(certs) || !bytes.Equal(decodedCerts[0], certs[0]) || !bytes.Equal(decodedCerts[1], certs[1]) {
+			t.Errorf("%s: keystore contains a different chain", test.name)
+		}
+	}
+}
+
+func TestEncodeJKSEmptyPassword(t *testing.T) {
+	certs, key := newTestChain(t)
+	tests := []struct {
+		name          string
+		storePassword string
+		keyPassword   string
+	}{
+		{"empty store password", "", ""},
+		{"empty store password with key password", "", "keypass"},
+	}
+	for _, test := range tests {
+		keyPassword := Secret{}
+		if test.keyPassword != "" {
+			keyPassword = newTestSecret(t, "CERTBUTLER_TEST_JKS_KEY_PASSWORD", test.keyPassword)
+		}
+		if _, err := EncodeJKS(certs, key, "", newTestSecret(t, "CERTBUTLER_TEST_JKS_STORE_PASSWORD", test.storePassword), keyPassword, false); err == nil {
+			t.Errorf("%s: EncodeJKS succeeded", test.name)
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package common
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"fmt"
+
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	pemTypeKeyEncrypted = "ENCRYPTED PRIVATE KEY"
+
+	// KDFScrypt derives the key encryption key with scrypt (RFC 7914)
+	KDFScrypt = "scrypt"
+	// KDFPBKDF2 derives the key encryption key with PBKDF2-HMAC-SHA256 (RFC 8018)
+	KDFPBKDF2 = "pbkdf2"
+
+	scryptCost        = 1 << 15
+	scryptBlockSize   = 8
+	scryptParallelism = 1
+	pbkdf2Iterations  = 600000
+	aesKeyLength      = 32
+	gcmNonceLength    = 12
+	gcmTagLength      = 16
+	kdfSaltLength     = 16
+)
+
+var (
+	oidPBES2          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2         = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidScrypt         = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11591, 4, 11}
+	oidHMACWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidAES256GCM      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 46}
+)
+
+type encryptedPrivateKeyInfo struct {
+	Algorithm     pkix.AlgorithmIdentifier
+	EncryptedData []byte
+}
+
+type pbes2Params struct {
+	KeyDerivationFunc pkix.AlgorithmIdentifier
+	EncryptionScheme  pkix.AlgorithmIdentifier
+}
+
+type pbkdf2Params struct {
+	Salt           []byte
+	IterationCount int
+	KeyLength      int `asn1:"optional"`
+	PRF            pkix.AlgorithmIdentifier
+}
+
+type scryptParams struct {
+	Salt                     []byte
+	CostParameter            int
+	BlockSize                int
+	ParallelizationParameter int
+	KeyLength                int `asn1:"optional"`
+}
+
+type gcmParams struct {
+	Nonce  []byte
+	ICVLen int `asn1:"default:12"`
+}
+
+// Enabled reports whether private keys should be stored encrypted
+func (keyEncryption KeyEncryptionConfiguration) Enabled() bool {
+	return keyEncryption.Passphrase.Configured()
+}
+
+// EncryptKeyPem encrypts a private key as PKCS#8 EncryptedPrivateKeyInfo with PBES2 (scrypt or PBKDF2 and AES-256-GCM)
+func EncryptKeyPem(key *ecdsa.PrivateKey, keyEncryption KeyEncryptionConfiguration) (*pem.Block, error) {
+	passphrase, err := keyEncryption.Passphrase.Read()
+	if err != nil {
+		return nil, fmt.Errorf("Reading key passphrase failed: %v", err)
+	}
+	if passphrase == "" {
+		return nil, fmt.Errorf("Key passphrase is empty")
+	}
+
+	plainKey, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	salt := make([]byte, kdfSaltLength)
+	nonce := make([]byte, gcmNonceLength)
+	if _, err = rand.Read(salt); err != nil {
+		return nil, err
+	}
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	var kdf pkix.AlgorithmIdentifier
+	var encryptionKey []byte
+	switch keyEncryption.KDF {
+	case "", KDFScrypt:
+		encryptionKey, err = scrypt.Key([]byte(passphrase), salt, scryptCost, scryptBlockSize, scryptParallelism, aesKeyLength)
+		if err != nil {
+			return nil, err
+		}
+		kdf.Algorithm = oidScrypt
+		kdf.Parameters, err = marshalRawValue(scryptParams{salt, scryptCost, scryptBlockSize, scryptParallelism, aesKeyLength})
+	case KDFPBKDF2:
+		encryptionKey = pbkdf2.Key([]byte(passphrase), salt, pbkdf2Iterations, aesKeyLength, sha256.New)
+		kdf.Algorithm = oidPBKDF2
+		kdf.Parameters, err = marshalRawValue(pbkdf2Params{salt, pbkdf2Iterations, aesKeyLength, pkix.AlgorithmIdentifier{Algorithm: oidHMACWithSHA256, Parameters: asn1.NullRawValue}})
+	default:
+		return nil, fmt.Errorf("Unknown key derivation function %s", keyEncryption.KDF)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := newGCM(encryptionKey)
+	if err != nil {
+		return nil, err
+	}
+	encryptedKey := aead.Seal(nil, nonce, plainKey, nil)
+
+	encryptionScheme := pkix.AlgorithmIdentifier{Algorithm: oidAES256GCM}
+	if encryptionScheme.Parameters, err = marshalRawValue(gcmParams{nonce, gcmTagLength}); err != nil {
+		return nil, err
+	}
+	pbes2, err := marshalRawValue(pbes2Params{kdf, encryptionScheme})
+	if err != nil {
+		return nil, err
+	}
+	der, err := asn1.Marshal(encryptedPrivateKeyInfo{
+		Algorithm:     pkix.AlgorithmIdentifier{Algorithm: oidPBES2, Parameters: pbes2},
+		EncryptedData: encryptedKey,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &pem.Block{Type: pemTypeKeyEncrypted, Bytes: der}, nil
+}
+
+// DecryptKey decrypts a PKCS#8 EncryptedPrivateKeyInfo created by EncryptKeyPem
+func DecryptKey(der []byte, keyEncryption KeyEncryptionConfiguration) (*ecdsa.PrivateKey, error) {
+	passphrase, err := keyEncryption.Passphrase.Read()
+	if err != nil {
+		return nil, fmt.Errorf("Reading key passphrase failed: %v", err)
+	}
+	if passphrase == "" {
+		return nil, fmt.Errorf("Key is encrypted but no passphrase is configured")
+	}
+
+	var info encryptedPrivateKeyInfo
+	if _, err = asn1.Unmarshal(der, &info); err != nil {
+		return nil, err
+	}
+	if !info.Algorithm.Algorithm.Equal(oidPBES2) {
+		return nil, fmt.Errorf("Unsupported key encryption %s", info.Algorithm.Algorithm)
+	}
+	var pbes2 pbes2Params
+	if _, err = asn1.Unmarshal(info.Algorithm.Parameters.FullBytes, &pbes2); err != nil {
+		return nil, err
+	}
+
+	var encryptionKey []byte
+	switch {
+	case pbes2.KeyDerivationFunc.Algorithm.Equal(oidScrypt):
+		var params scryptParams
+		if _, err = asn1.Unmarshal(pbes2.KeyDerivationFunc.Parameters.FullBytes, &params); err != nil {
+			return nil, err
+		}
+		encryptionKey, err = scrypt.Key([]byte(passphrase), params.Salt, params.CostParameter, params.BlockSize, params.ParallelizationParameter, aesKeyLength)
+		if err != nil {
+			return nil, err
+		}
+	case pbes2.KeyDerivationFunc.Algorithm.Equal(oidPBKDF2):
+		var params pbkdf2Params
+		if _, err = asn1.Unmarshal(pbes2.KeyDerivationFunc.Parameters.FullBytes, &params); err != nil {
+			return nil, err
+		}
+		if !params.PRF.Algorithm.Equal(oidHMACWithSHA256) {
+			return nil, fmt.Errorf("Unsupported PBKDF2 pseudorandom function %s", params.PRF.Algorithm)
+		}
+		encryptionKey = pbkdf2.Key([]byte(passphrase), params.Salt, params.IterationCount, aesKeyLength, sha256.New)
+	default:
+		return nil, fmt.Errorf("Unsupported key derivation function %s", pbes2.KeyDerivationFunc.Algorithm)
+	}
+
+	if !pbes2.EncryptionScheme.Algorithm.Equal(oidAES256GCM) {
+		return nil, fmt.Errorf("Unsupported key encryption scheme %s", pbes2.EncryptionScheme.Algorithm)
+	}
+	var params gcmParams
+	if _, err = asn1.Unmarshal(pbes2.EncryptionScheme.Parameters.FullBytes, &params); err != nil {
+		return nil, err
+	}
+	if len(params.Nonce) != gcmNonceLength || params.ICVLen != gcmTagLength {
+		return nil, fmt.Errorf("Unsupported AES-GCM parameters")
+	}
+
+	aead, err := newGCM(encryptionKey)
+	if err != nil {
+		return nil, err
+	}
+	plainKey, err := aead.Open(nil, params.Nonce, info.EncryptedData, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Decrypting key failed (wrong passphrase?)")
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(plainKey)
+	if err != nil {
+		return nil, err
+	}
+	ecKey, ok := key.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("Encrypted key is no ECDSA key")
+	}
+	return ecKey, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCMWithTagSize(block, gcmTagLength)
+}
+
+func marshalRawValue(value interface{}) (asn1.RawValue, error) {
+	der, err := asn1.Marshal(value)
+	if err != nil {
+		return asn1.RawValue{}, err
+	}
+	return asn1.RawValue{FullBytes: der}, nil
+}
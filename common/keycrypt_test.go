@@ -0,0 +1,66 @@
+package common
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"testing"
+)
+
+// newTestSecret returns a secret read from the environment variable name, which is set to value for the test
+func newTestSecret(t *testing.T, name, value string) Secret {
+	t.Setenv(name, value)
+	return Secret{Env: name}
+}
+
+func newTestKey(t *testing.T) *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestKeyEncryption(t *testing.T) {
+	tests := []struct {
+		name          string
+		kdf           string
+		decryptWith   string
+		wantDecrypted bool
+	}{
+		{"scrypt", "", "passphrase", true},
+		{"pbkdf2", KDFPBKDF2, "passphrase", true},
+		{"scrypt wrong passphrase", KDFScrypt, "wrong", false},
+		{"pbkdf2 wrong passphrase", KDFPBKDF2, "wrong", false},
+		{"empty passphrase", "", "", false},
+	}
+	key := newTestKey(t)
+	for _, test := range tests {
+		encryption := KeyEncryptionConfiguration{Passphrase: newTestSecret(t, "CERTBUTLER_TEST_PASSPHRASE", "passphrase"), KDF: test.kdf}
+		block, err := EncryptKeyPem(key, encryption)
+		if err != nil {
+			t.Fatalf("%s: EncryptKeyPem failed: %v", test.name, err)
+		}
+
+		decryption := KeyEncryptionConfiguration{Passphrase: newTestSecret(t, "CERTBUTLER_TEST_PASSPHRASE", test.decryptWith)}
+		decrypted, err := DecryptKey(block.Bytes, decryption)
+		if !test.wantDecrypted {
+			if err == nil {
+				t.Errorf("%s: DecryptKey succeeded", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: DecryptKey failed: %v", test.name, err)
+		} else if decrypted.D.Cmp(key.D) != 0 {
+			t.Errorf("%s: DecryptKey returned a different key", test.name)
+		}
+	}
+}
+
+func TestKeyEncryptionEmptyPassphrase(t *testing.T) {
+	encryption := KeyEncryptionConfiguration{Passphrase: newTestSecret(t, "CERTBUTLER_TEST_PASSPHRASE", "")}
+	if _, err := EncryptKeyPem(newTestKey(t), encryption); err == nil {
+		t.Error("EncryptKeyPem with an empty passphrase succeeded")
+	}
+}
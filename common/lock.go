@@ -0,0 +1,62 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+const lockPollInterval = 500 * time.Millisecond
+
+// ErrLocked is returned if a lock file is held by another process and the lock mode is "skip"
+var ErrLocked = errors.New("Lock is held by another process")
+
+// LockFile acquires an exclusive advisory lock on filename, shared with other certbutler processes (e.g. on a shared volume)
+// Depending on the configuration, it waits (optionally with timeout) or fails with ErrLocked if the lock is held.
+func LockFile(ctx context.Context, filename string, config LockConfiguration) (func(), error) {
+	if config.Mode != "" && config.Mode != "wait" && config.Mode != "skip" {
+		return nil, fmt.Errorf("Unknown lock mode %s", config.Mode)
+	}
+
+	file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	var deadline <-chan time.Time
+	if config.TimeoutSeconds > 0 {
+		timer := time.NewTimer(time.Duration(config.TimeoutSeconds) * time.Second)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	for {
+		locked, err := tryLock(file)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		if locked {
+			return func() {
+				unlock(file)
+				file.Close()
+			}, nil
+		}
+		if config.Mode == "skip" {
+			file.Close()
+			return nil, ErrLocked
+		}
+
+		select {
+		case <-time.After(lockPollInterval):
+		case <-deadline:
+			file.Close()
+			return nil, fmt.Errorf("Timeout waiting for lock %s", filename)
+		case <-ctx.Done():
+			file.Close()
+			return nil, ctx.Err()
+		}
+	}
+}
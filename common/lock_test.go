@@ -0,0 +1,85 @@
+package common
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestLockFile(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "certbutler-lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return filepath.Join(dir, "account.pem.lock")
+}
+
+func TestLockFile(t *testing.T) {
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		name    string
+		ctx     context.Context
+		config  LockConfiguration
+		wantErr error // nil if any error is expected
+	}{
+		{"skip", context.Background(), LockConfiguration{Mode: "skip"}, ErrLocked},
+		{"wait with timeout", context.Background(), LockConfiguration{Mode: "wait", TimeoutSeconds: 1}, nil},
+		{"wait canceled", canceled, LockConfiguration{}, context.Canceled},
+		{"unknown mode", context.Background(), LockConfiguration{Mode: "fail"}, nil},
+	}
+	for _, test := range tests {
+		filename := newTestLockFile(t)
+		unlock, err := LockFile(context.Background(), filename, LockConfiguration{})
+		if err != nil {
+			t.Fatalf("%s: LockFile failed: %v", test.name, err)
+		}
+
+		// the lock is held => a second lock fails as configured
+		if second, err := LockFile(test.ctx, filename, test.config); err == nil {
+			second()
+			t.Errorf("%s: lock was acquired twice", test.name)
+		} else if test.wantErr != nil && err != test.wantErr {
+			t.Errorf("%s: LockFile returned %v, want %v", test.name, err, test.wantErr)
+		}
+
+		// the released lock can be acquired again
+		unlock()
+		if test.config.Mode == "fail" {
+			continue
+		}
+		second, err := LockFile(context.Background(), filename, test.config)
+		if err != nil {
+			t.Errorf("%s: LockFile after unlock failed: %v", test.name, err)
+			continue
+		}
+		second()
+	}
+}
+
+func TestLockFileWaits(t *testing.T) {
+	filename := newTestLockFile(t)
+	unlock, err := LockFile(context.Background(), filename, LockConfiguration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		unlock()
+	}()
+
+	start := time.Now()
+	second, err := LockFile(context.Background(), filename, LockConfiguration{Mode: "wait", TimeoutSeconds: 10})
+	if err != nil {
+		t.Fatalf("LockFile failed: %v", err)
+	}
+	second()
+	if time.Since(start) < 100*time.Millisecond {
+		t.Error("LockFile did not wait for the lock to be released")
+	}
+}
@@ -0,0 +1,22 @@
+package common
+
+import (
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+// lockBytes covers the whole file, independent of its size
+const lockBytes = ^uint32(0)
+
+func tryLock(file *os.File) (bool, error) {
+	err := windows.LockFileEx(windows.Handle(file.Fd()), windows.LOCKFILE_EXCLUSIVE_LOCK|windows.LOCKFILE_FAIL_IMMEDIATELY, 0, lockBytes, lockBytes, &windows.Overlapped{})
+	if err == windows.ERROR_LOCK_VIOLATION {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func unlock(file *os.File) {
+	windows.UnlockFileEx(windows.Handle(file.Fd()), 0, lockBytes, lockBytes, &windows.Overlapped{})
+}
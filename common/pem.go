@@ -1,7 +1,6 @@
 package common
 
 import (
-	"bufio"
 	"bytes"
 	"crypto/ecdsa"
 	"crypto/x509"
@@ -9,45 +8,52 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
-	"strings"
+
+	log "github.com/sirupsen/logrus"
 )
 
 const (
-	pemTypeKey  = "EC PRIVATE KEY"
-	pemTypeCert = "CERTIFICATE"
+	pemTypeKey      = "EC PRIVATE KEY"
+	pemTypeKeyPKCS8 = "PRIVATE KEY"
+	pemTypeCert     = "CERTIFICATE"
+
+	// KeyFormatEC stores keys in the SEC 1 format ("EC PRIVATE KEY")
+	KeyFormatEC = "ec"
+	// KeyFormatPKCS8 stores keys in the PKCS#8 format ("PRIVATE KEY")
+	KeyFormatPKCS8 = "pkcs8"
 )
 
 // SaveToPEMFile saves certiceates and key pem encoded to a file
-func SaveToPEMFile(filename string, key *ecdsa.PrivateKey, certs [][]byte) error {
-	// if file already exists rotate the old file
-	if _, err := os.Stat(filename); err == nil {
-		name, extension := "", ""
-		if offset := strings.LastIndex(filename, "."); offset == -1 {
-			name = filename
-		} else {
-			name = filename[:offset]
-			extension = filename[offset:]
+// If the file already exists, the old version is moved to the archive according to the archive configuration
+func SaveToPEMFile(filename string, key *ecdsa.PrivateKey, certs [][]byte, options FileOptions) error {
+	var fileData []byte
+	var err error
+	if key != nil && options.KeyEncryption.Enabled() {
+		fileData, err = EncodePem(nil, certs)
+		if err != nil {
+			return err
 		}
-		for i := 0; ; i++ {
-			nextFilename := fmt.Sprintf("%s-%d%s", name, i, extension)
-			if _, err := os.Stat(nextFilename); err != nil {
-				if err = os.Rename(filename, nextFilename); err != nil {
-					return err
-				}
-				break
-			}
+		keyBlock, err := EncryptKeyPem(key, options.KeyEncryption)
+		if err != nil {
+			return err
+		}
+		fileData = append(fileData, pem.EncodeToMemory(keyBlock)...)
+	} else {
+		fileData, err = EncodePemWithKeyFormat(key, certs, options.KeyFormat)
+		if err != nil {
+			return err
 		}
 	}
-
-	fileData, err := EncodePem(key, certs)
-	if err != nil {
-		return err
-	}
-	return ioutil.WriteFile(filename, fileData, 0600)
+	return SaveToFile(filename, fileData, options)
 }
 
 // EncodePem encodes certificates and key in PEM format
 func EncodePem(key *ecdsa.PrivateKey, certs [][]byte) ([]byte, error) {
+	return EncodePemWithKeyFormat(key, certs, KeyFormatEC)
+}
+
+// EncodePemWithKeyFormat encodes certificates and key in PEM format with the key stored in the given format
+func EncodePemWithKeyFormat(key *ecdsa.PrivateKey, certs [][]byte, keyFormat string) ([]byte, error) {
 	var buf bytes.Buffer
 
 	for _, cert := range certs {
@@ -61,14 +67,24 @@ func EncodePem(key *ecdsa.PrivateKey, certs [][]byte) ([]byte, error) {
 	}
 
 	if key != nil {
-		keyBytes, err := x509.MarshalECPrivateKey(key)
-		if err != nil {
-			return nil, err
+		var keyBlock *pem.Block
+		switch keyFormat {
+		case "", KeyFormatEC:
+			keyBytes, err := x509.MarshalECPrivateKey(key)
+			if err != nil {
+				return nil, err
+			}
+			keyBlock = &pem.Block{Type: pemTypeKey, Bytes: keyBytes}
+		case KeyFormatPKCS8:
+			keyBytes, err := x509.MarshalPKCS8PrivateKey(key)
+			if err != nil {
+				return nil, err
+			}
+			keyBlock = &pem.Block{Type: pemTypeKeyPKCS8, Bytes: keyBytes}
+		default:
+			return nil, fmt.Errorf("Unknown key format %s", keyFormat)
 		}
-		err = pem.Encode(&buf, &pem.Block{
-			Type:  pemTypeKey,
-			Bytes: keyBytes,
-		})
+		err := pem.Encode(&buf, keyBlock)
 		if err != nil {
 			return nil, err
 		}
@@ -77,54 +93,48 @@ func EncodePem(key *ecdsa.PrivateKey, certs [][]byte) ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
-// LoadKeyFromPEMFile parses a key from a pem file. Skip specifies how many keys are skipped before the next one is parsed and returned.
-func LoadKeyFromPEMFile(filename string, skip int) (*ecdsa.PrivateKey, error) {
-	dataBytes, err := loadFromPem(filename, pemTypeKey, skip)
+// LoadKey parses the first private key from a pem file. EC, PKCS#8 and encrypted PKCS#8 keys are supported.
+func LoadKey(filename string, keyEncryption KeyEncryptionConfiguration) (*ecdsa.PrivateKey, error) {
+	pemBytes, err := ioutil.ReadFile(filename)
 	if err != nil {
 		return nil, err
 	}
-	return x509.ParseECPrivateKey(dataBytes)
+	return ParseKey(pemBytes, keyEncryption)
 }
 
-// LoadCertFromPEMFile parses a certificate from a pem file. Skip specifies how many certificates are skipped before the next one is parsed and returned.
-func LoadCertFromPEMFile(filename string, skip int) (*x509.Certificate, error) {
-	dataBytes, err := loadFromPem(filename, pemTypeCert, skip)
+// ParseKey parses the first private key from pem data. EC, PKCS#8 and encrypted PKCS#8 keys are supported.
+func ParseKey(pemBytes []byte, keyEncryption KeyEncryptionConfiguration) (*ecdsa.PrivateKey, error) {
+	bundle, err := ParseBundle(pemBytes)
 	if err != nil {
 		return nil, err
 	}
-	return x509.ParseCertificate(dataBytes)
+	if len(bundle.Keys) > 0 {
+		return bundle.ECKey()
+	}
+	for _, block := range bundle.Other {
+		if block.Type == pemTypeKeyEncrypted {
+			return DecryptKey(block.Bytes, keyEncryption)
+		}
+	}
+	return nil, fmt.Errorf("No private key found")
 }
 
-func loadFromPem(filename, desc string, skip int) ([]byte, error) {
-	pemFile, err := os.Open(filename)
+// KeyEncrypted returns whether the first private key in a pem file is encrypted
+func KeyEncrypted(filename string) (bool, error) {
+	pemBytes, err := ioutil.ReadFile(filename)
 	if err != nil {
-		return nil, err
+		return false, err
 	}
-	defer pemFile.Close()
-
-	pemfileinfo, _ := pemFile.Stat()
-	var size int64 = pemfileinfo.Size()
-	pemBytes := make([]byte, size)
-	buffer := bufio.NewReader(pemFile)
-	_, err = buffer.Read(pemBytes)
-	if err != nil {
-		return nil, err
+	bundle, err := ParseBundle(pemBytes)
+	if err != nil || len(bundle.Keys) > 0 {
+		return false, err
 	}
-
-	for {
-		var pemBlock *pem.Block
-		pemBlock, pemBytes = pem.Decode(pemBytes)
-		if pemBlock == nil {
-			return nil, fmt.Errorf("No pem block of type %s found after skipping %d blocks of same type", desc, skip)
-		}
-		if pemBlock.Type == desc {
-			if skip > 0 {
-				skip--
-				continue
-			}
-			return pemBlock.Bytes, nil
+	for _, block := range bundle.Other {
+		if block.Type == pemTypeKeyEncrypted {
+			return true, nil
 		}
 	}
+	return false, nil
 }
 
 // FlattenStringSlice joins strings from a slice with commas for printing
@@ -141,22 +151,70 @@ func FlattenStringSlice(stringSlice []string) string {
 }
 
 // WriteCertToFile writes Certificates and Key to PEM Files
-// When singleFile is true, cert and key are bothes stored in certFile, otherwise they are stored in two separate files
-func WriteCertToFile(certs [][]byte, key *ecdsa.PrivateKey, certFile, keyFile string, singleFile bool) error {
-	if singleFile {
-		err := SaveToPEMFile(certFile, key, certs)
+// When SingleFile is set, cert and key are bothes stored in CertFile, otherwise they are stored in two separate files.
+// Additionally, the leaf, the chain and the full chain as well as other configured formats are written to separate files.
+// With SkipPEM, CertFile and KeyFile are not written and the other formats are used instead.
+func WriteCertToFile(certs [][]byte, key *ecdsa.PrivateKey, filesConfig FilesConfiguration) error {
+	certOptions := FileOptions{Permissions: filesConfig.CertPermissions, Archive: filesConfig.Archive}
+	// files containing the key are protected like the key file
+	keyOptions := FileOptions{Permissions: filesConfig.KeyPermissions, Archive: filesConfig.Archive, KeyFormat: filesConfig.KeyFormat, KeyEncryption: filesConfig.KeyEncryption}
+
+	if filesConfig.SkipPEM {
+		if filesConfig.PKCS12File == "" && filesConfig.DERLeafFile == "" {
+			return fmt.Errorf("Skipping PEM files needs a PKCS#12 or DER leaf file to keep the certificate")
+		}
+	} else if filesConfig.SingleFile {
+		err := SaveToPEMFile(filesConfig.CertFile, key, certs, keyOptions)
 		if err != nil {
 			return err
 		}
 	} else {
-		err := SaveToPEMFile(certFile, nil, certs)
+		err := SaveToPEMFile(filesConfig.CertFile, nil, certs, certOptions)
 		if err != nil {
 			return err
 		}
-		err = SaveToPEMFile(keyFile, key, nil)
+		err = SaveToPEMFile(filesConfig.KeyFile, key, nil, keyOptions)
 		if err != nil {
 			return err
 		}
 	}
+
+	layouts := []struct {
+		filename string
+		certs    [][]byte
+	}{
+		{filesConfig.LeafFile, certs[:1]},
+		{filesConfig.ChainFile, certs[1:]},
+		{filesConfig.FullchainFile, certs},
+	}
+	for _, layout := range layouts {
+		if layout.filename == "" {
+			continue
+		}
+		if len(layout.certs) == 0 {
+			// no intermediates => an empty chain file would only break its consumers
+			if err := removeEmptyLayout(layout.filename, certOptions); err != nil {
+				return err
+			}
+			continue
+		}
+		err := SaveToPEMFile(layout.filename, nil, layout.certs, certOptions)
+		if err != nil {
+			return err
+		}
+	}
+
+	return writeAdditionalFormats(certs, key, filesConfig, certOptions, keyOptions)
+}
+
+// removeEmptyLayout archives and removes a file which would be written without certificates, so no stale chain of an older certificate is left
+func removeEmptyLayout(filename string, options FileOptions) error {
+	log.Warnf("Certificate has no intermediates, not writing %s", filename)
+	if err := ArchiveFile(filename, options.Archive); err != nil {
+		return err
+	}
+	if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+		return err
+	}
 	return nil
 }
@@ -0,0 +1,47 @@
+package common
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteCertToFileWithoutIntermediates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certbutler-pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	files := FilesConfiguration{
+		CertFile:      filepath.Join(dir, "cert.pem"),
+		KeyFile:       filepath.Join(dir, "key.pem"),
+		ChainFile:     filepath.Join(dir, "chain.pem"),
+		FullchainFile: filepath.Join(dir, "fullchain.pem"),
+		DERChainFile:  filepath.Join(dir, "chain.der"),
+	}
+	certs, key := newTestChain(t)
+
+	if err = WriteCertToFile(certs, key, files); err != nil {
+		t.Fatalf("WriteCertToFile failed: %v", err)
+	}
+	for _, filename := range []string{files.ChainFile, files.DERChainFile} {
+		if info, err := os.Stat(filename); err != nil || info.Size() == 0 {
+			t.Errorf("%s was not written: %v", filename, err)
+		}
+	}
+
+	// a certificate without intermediates must neither leave empty chain files nor the chain of the previous certificate
+	if err = WriteCertToFile(certs[:1], key, files); err != nil {
+		t.Fatalf("WriteCertToFile without intermediates failed: %v", err)
+	}
+	for _, filename := range []string{files.ChainFile, files.DERChainFile} {
+		if _, err := os.Stat(filename); !os.IsNotExist(err) {
+			t.Errorf("%s still exists: %v", filename, err)
+		}
+	}
+	bundle, err := LoadBundle(files.FullchainFile)
+	if err != nil || len(bundle.Certificates) != 1 {
+		t.Errorf("Full chain is not the leaf only: %v", err)
+	}
+}
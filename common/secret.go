@@ -0,0 +1,43 @@
+package common
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Configured reports whether a source for the secret is configured
+func (secret Secret) Configured() bool {
+	return secret.Env != "" || secret.File != "" || secret.Credential != ""
+}
+
+// Read returns the secret from the configured environment variable, file or systemd credential
+// An empty secret is returned if no source is configured.
+func (secret Secret) Read() (string, error) {
+	if secret.Env != "" {
+		value, ok := os.LookupEnv(secret.Env)
+		if !ok {
+			return "", fmt.Errorf("Environment variable %s is not set", secret.Env)
+		}
+		return value, nil
+	}
+
+	filename := secret.File
+	if secret.Credential != "" {
+		credentialsDirectory := os.Getenv("CREDENTIALS_DIRECTORY")
+		if credentialsDirectory == "" {
+			return "", fmt.Errorf("Credential %s requested but CREDENTIALS_DIRECTORY is not set (LoadCredential= missing in the systemd unit?)", secret.Credential)
+		}
+		filename = filepath.Join(credentialsDirectory, secret.Credential)
+	}
+	if filename != "" {
+		value, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(value), "\r\n"), nil
+	}
+	return "", nil
+}
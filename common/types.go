@@ -4,9 +4,17 @@ import "crypto/ecdsa"
 
 // Config is the struct holding all configuration for a certificate. The config file is parsed into this struct.
 type Config struct {
+	Name        string // name used in logs and summaries; defaults to the config file name
 	Timing      TimingConfiguration
 	Certificate CertificateConfiguration
 	Files       FilesConfiguration
+	CT          CTConfiguration
+	OCSP        OCSPConfiguration
+	CRL         CRLConfiguration
+	Storage     StorageConfiguration
+	State       StateConfiguration
+	Lock        LockConfiguration
+	Cluster     ClusterConfiguration
 	HaProxy     HaProxyConfiguration
 	Nginx       NginxConfiguration
 	DeployHook  DeployHookConfiguration
@@ -15,24 +23,162 @@ type Config struct {
 // TimingConfiguration stores the values defining scheduling and due dates
 type TimingConfiguration struct {
 	RunIntervalMinutes int
-	RenewalDueCert     int // remaining valid days of the certitifcate before renew; set to 0 to disable Certificate refresh
-	RenewalDueOCSP     int // remaining valid days of the OCSP response before renew; set to 0 to disable OCSP refresh
+	Schedule           string // cron expression (e.g. "0 */6 * * *") used instead of RunIntervalMinutes
+	JitterSeconds      int    // random delay of up to this many seconds before every run
+	DeployWindow       string // daily time range (e.g. "02:00-05:00", local time) for running post-processors; leave empty to deploy immediately
+	RenewalDueCert     int    // remaining valid days of the certitifcate before renew; set to 0 to disable Certificate refresh
+	RenewalDueOCSP     int    // remaining valid days of the OCSP response before renew; set to 0 to disable OCSP refresh
 }
 
 // CertificateConfiguration stores Certificate content ACME account data
 type CertificateConfiguration struct {
-	DNSNames        []string
-	MustStaple      bool
-	AcmeDirectory   string
-	AcmeAccountFile string
-	RegisterAcme    bool
+	DNSNames         []string
+	MustStaple       bool
+	AcmeDirectory    string
+	AcmeAccountFile  string
+	RegisterAcme     bool
+	CheckCAA         bool   // check CAA records of all DNSNames against the CA before ordering
+	CAAResolver      string // resolver used for the CAA check; leave empty to use the one from /etc/resolv.conf
+	TrustedRootsFile string // pem file with roots issued certificates have to chain to; leave empty to use the system roots
+}
+
+// CTConfiguration stores how the certificate transparency of issued certificates is verified
+type CTConfiguration struct {
+	LogListFile string // log list in the google log list format; leave empty to disable SCT verification
+	MinSCTs     int    // minimal number of distinct logs with a valid SCT; defaults to 2
+}
+
+// OCSPConfiguration stores how OCSP responses are fetched
+type OCSPConfiguration struct {
+	Only           bool     // only refresh OCSP responses for an existing certificate managed elsewhere; the ACME part is skipped
+	IssuerFile     string   // pem file with the issuer certificate; only needed if the chain is not stored and the certificate has no caIssuers URL
+	Responders     []string // responder URLs used instead of the ones from the certificate
+	TimeoutSeconds int      // timeout per responder request; defaults to 10 seconds
+	Proxy          string   // http proxy URL; defaults to the HTTP_PROXY/HTTPS_PROXY environment variables
+	CACertFile     string   // pem file with CAs trusted for https responders instead of the system roots
+	Listen         string   // address of the built-in responder serving the stored response (e.g. ":8080"); leave empty to disable
+}
+
+// CRLConfiguration stores whether and how certificates are checked against their CRLs
+type CRLConfiguration struct {
+	Enabled  bool   // check the certificate against the CRLs from its CRL distribution points on every run
+	CacheDir string // directory to keep downloaded CRLs until their next update; leave empty to only cache in memory
+}
+
+// StorageConfiguration stores where certificates, keys and OCSP responses are kept
+type StorageConfiguration struct {
+	Backend        string // storage backend; "file" (default) uses the layout from FilesConfiguration, "vault" a vault KV v2 secret, "s3" an S3 compatible bucket
+	KeepLocalFiles bool   // additionally write all files from FilesConfiguration when another backend is used
+	Vault          VaultConfiguration
+	S3             S3Configuration
+}
+
+// VaultConfiguration stores how certbutler accesses a HashiCorp Vault KV v2 secrets engine
+type VaultConfiguration struct {
+	Address      string // e.g. https://vault.example.com:8200
+	Namespace    string // vault enterprise namespace; leave empty if not used
+	CACertFile   string // pem file with the CA of the vault server; leave empty to use the system roots
+	Mount        string // mount path of the KV v2 engine; defaults to "secret"
+	Path         string // path of the secret holding certificate, chain, key and OCSP response
+	AccountPath  string // path of the secret holding the acme account key; leave empty to use the local AcmeAccountFile
+	AuthMethod   string // "token" (default) or "approle"
+	Token        Secret // token for the token auth method (e.g. a vault agent sink file)
+	RoleID       string // role id for the approle auth method
+	SecretID     Secret // secret id for the approle auth method
+	AppRoleMount string // mount path of the approle auth method; defaults to "approle"
+}
+
+// S3Configuration stores how certbutler accesses an S3 compatible bucket
+type S3Configuration struct {
+	Endpoint             string // e.g. https://s3.eu-central-1.amazonaws.com or https://minio.example.com:9000
+	Region               string // defaults to "us-east-1"
+	Bucket               string
+	PathStyle            bool   // address the bucket in the path instead of the host name (needed for most MinIO setups)
+	Prefix               string // prepended to all object names, e.g. "certs/example.com/"
+	AccountKeyObject     string // object holding the acme account key; leave empty to use the local AcmeAccountFile
+	AccessKeyID          string
+	SecretAccessKey      Secret
+	ServerSideEncryption string // "AES256" or "aws:kms"; leave empty to use the bucket default
+	KMSKeyID             string // kms key used with "aws:kms"
 }
 
 // FilesConfiguration stores how received content to files
 type FilesConfiguration struct {
 	SingleFile bool   // store cert and key CertFile (for e.g. haproxy)
+	SkipPEM    bool   // write only the other configured formats instead of CertFile and KeyFile; they are read back from PKCS12File or DERLeafFile
 	CertFile   string // store cert and key in two files (for e.g. nginx)
 	KeyFile    string // store cert and key in two files (for e.g. nginx)
+	OCSPFile   string // file for the OCSP response; defaults to CertFile with suffix ".ocsp"
+
+	LeafFile      string // additionally store only the leaf certificate (like certbot's cert.pem); leave empty to disable
+	ChainFile     string // additionally store only the intermediate certificates (like certbot's chain.pem); leave empty to disable, removed if there are no intermediates
+	FullchainFile string // additionally store leaf and intermediates (like certbot's fullchain.pem); leave empty to disable
+
+	KeyFormat                string                     // format of the key in KeyFile/CertFile: "ec" (default) or "pkcs8"; ignored for encrypted keys
+	KeyEncryption            KeyEncryptionConfiguration // encryption of KeyFile/CertFile and the acme account key
+	DERLeafFile              string                     // additionally store the leaf certificate DER encoded; leave empty to disable
+	DERChainFile             string                     // additionally store the intermediate certificates as concatenated DER; leave empty to disable, removed if there are no intermediates
+	PKCS12File               string                     // additionally store key and certificates as PKCS#12 bundle (.p12/.pfx); leave empty to disable
+	PKCS12Password           Secret                     // password protecting the PKCS#12 bundle
+	PKCS12AllowEmptyPassword bool                       // write the PKCS#12 bundle without password instead of failing
+
+	JKSFile               string // additionally store key and certificates in a java keystore; leave empty to disable
+	JKSAlias              string // alias of the key entry in the java keystore; defaults to "certbutler"
+	JKSStorePassword      Secret // password protecting the integrity of the java keystore
+	JKSKeyPassword        Secret // password protecting the key entry; defaults to the store password
+	JKSAllowEmptyPassword bool   // write the java keystore with empty store or key password instead of failing
+
+	CertPermissions FilePermissions // applied to certificate files
+	KeyPermissions  FilePermissions // applied to the key file and to CertFile when SingleFile is set
+	OCSPPermissions FilePermissions // applied to the OCSP response file
+
+	Archive ArchiveConfiguration
+}
+
+// FilePermissions stores ownership and mode of written files
+type FilePermissions struct {
+	Owner string // user name or uid; leave empty to keep the user running certbutler
+	Group string // group name or gid; leave empty to keep the primary group of the user running certbutler
+	Mode  string // octal file mode (e.g. "0640"); leave empty for 0600
+}
+
+// Secret stores where a password is read from
+type Secret struct {
+	Env        string // name of the environment variable containing the secret
+	File       string // file containing the secret; a trailing newline is ignored
+	Credential string // name of a systemd credential (read from $CREDENTIALS_DIRECTORY)
+}
+
+// KeyEncryptionConfiguration stores whether and how private keys are encrypted on disk
+type KeyEncryptionConfiguration struct {
+	Passphrase Secret // leave unset to store keys unencrypted
+	KDF        string // key derivation function: "scrypt" (default) or "pbkdf2"
+}
+
+// StateConfiguration stores where the run state and history of a configuration is kept
+type StateConfiguration struct {
+	Directory string // directory for the json state files; leave empty to not keep any state
+}
+
+// LockConfiguration stores how certbutler processes sharing certificate files or an acme account coordinate
+type LockConfiguration struct {
+	Mode           string // "wait" (default) waits for a lock held by another process, "skip" skips the run
+	TimeoutSeconds int    // maximum time to wait for a lock; 0 waits indefinitely
+}
+
+// ClusterConfiguration stores how nodes sharing a certificate elect the leader which talks to the CA
+type ClusterConfiguration struct {
+	Backend      string // "leasefile" enables the cluster mode; leave empty to run standalone
+	LeaseFile    string // lease file on storage shared by all nodes
+	NodeID       string // name of this node; defaults to the hostname
+	LeaseSeconds int    // validity of the lease; defaults to twice the run interval or one hour
+}
+
+// ArchiveConfiguration stores where replaced files are kept and for how long
+type ArchiveConfiguration struct {
+	Directory      string // leave empty to use the directory "archive" next to the files
+	RetentionCount int    // number of old generations kept per file; 0 keeps all (if RetentionDays is set) or 5 (otherwise)
+	RetentionDays  int    // old generations are removed after this number of days; set to 0 to keep them regardless of age
 }
 
 // HaProxyConfiguration stores whether and how certbutler interacts with haproxy
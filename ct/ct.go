@@ -0,0 +1,351 @@
+package ct
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"felix-hartmond.de/projects/certbutler/common"
+)
+
+const defaultMinSCTs = 2
+
+var oidSCTList = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11129, 2, 4, 2}
+
+// Log is a certificate transparency log from the log list
+type Log struct {
+	Description string
+	Operator    string
+	ID          [32]byte
+	Key         crypto.PublicKey
+	State       string    // state of the log in the log list, e.g. "usable" or "retired"; empty if the list has none
+	StateSince  time.Time // time the log entered its state
+}
+
+// Trusted returns whether an SCT of the log issued at the given time is accepted
+// Pending and rejected logs are never trusted, retired logs only for SCTs issued before their retirement.
+func (l *Log) Trusted(timestamp time.Time) bool {
+	switch l.State {
+	case "pending", "rejected":
+		return false
+	case "retired":
+		return timestamp.Before(l.StateSince)
+	}
+	return true
+}
+
+// SCTResult holds the verification result of one embedded SCT
+type SCTResult struct {
+	LogID     [32]byte
+	Log       *Log // nil if the log is not in the log list
+	Timestamp time.Time
+	Err       error
+}
+
+func (r SCTResult) String() string {
+	name := base64.StdEncoding.EncodeToString(r.LogID[:])
+	if r.Log != nil {
+		name = r.Log.Description
+	}
+	if r.Err != nil {
+		return fmt.Sprintf("%s: %v", name, r.Err)
+	}
+	return fmt.Sprintf("%s: valid", name)
+}
+
+// logList is the subset of the Google log list format (v2/v3) used by certbutler
+type logList struct {
+	Operators []struct {
+		Name string `json:"name"`
+		Logs []struct {
+			Description string `json:"description"`
+			LogID       string `json:"log_id"`
+			Key         string `json:"key"`
+			State       map[string]struct {
+				Timestamp time.Time `json:"timestamp"`
+			} `json:"state"`
+		} `json:"logs"`
+	} `json:"operators"`
+}
+
+// LoadLogList parses a log list file in the Google log list format
+func LoadLogList(filename string) (map[[32]byte]*Log, error) {
+	listBytes, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var list logList
+	if err = json.Unmarshal(listBytes, &list); err != nil {
+		return nil, fmt.Errorf("Parsing log list %s failed: %v", filename, err)
+	}
+
+	logs := map[[32]byte]*Log{}
+	for _, operator := range list.Operators {
+		for _, entry := range operator.Logs {
+			keyBytes, err := base64.StdEncoding.DecodeString(entry.Key)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid key of log %s: %v", entry.Description, err)
+			}
+			key, err := x509.ParsePKIXPublicKey(keyBytes)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid key of log %s: %v", entry.Description, err)
+			}
+			// the log id is defined as hash of the key, the listed one is only used for cross checking
+			id := sha256.Sum256(keyBytes)
+			if listedID, err := base64.StdEncoding.DecodeString(entry.LogID); err == nil && !bytes.Equal(listedID, id[:]) {
+				return nil, fmt.Errorf("Log id of log %s does not match its key", entry.Description)
+			}
+			l := &Log{Description: entry.Description, Operator: operator.Name, ID: id, Key: key}
+			for state, details := range entry.State {
+				l.State, l.StateSince = state, details.Timestamp
+			}
+			logs[id] = l
+		}
+	}
+	return logs, nil
+}
+
+// VerifyEmbeddedSCTs parses the embedded SCTs of a leaf certificate and verifies their signatures against the known logs
+func VerifyEmbeddedSCTs(leaf, issuer *x509.Certificate, logs map[[32]byte]*Log) ([]SCTResult, error) {
+	var sctListExtension []byte
+	for _, extension := range leaf.Extensions {
+		if extension.Id.Equal(oidSCTList) {
+			sctListExtension = extension.Value
+		}
+	}
+	if sctListExtension == nil {
+		return nil, fmt.Errorf("Certificate contains no embedded SCTs")
+	}
+
+	var sctList []byte
+	if _, err := asn1.Unmarshal(sctListExtension, &sctList); err != nil {
+		return nil, fmt.Errorf("Parsing SCT list extension failed: %v", err)
+	}
+	scts, err := splitSCTList(sctList)
+	if err != nil {
+		return nil, err
+	}
+
+	precertTBS, err := buildPrecertTBS(leaf.RawTBSCertificate)
+	if err != nil {
+		return nil, err
+	}
+	issuerKeyHash := sha256.Sum256(issuer.RawSubjectPublicKeyInfo)
+
+	results := []SCTResult{}
+	for _, rawSCT := range scts {
+		results = append(results, verifySCT(rawSCT, precertTBS, issuerKeyHash, logs))
+	}
+	return results, nil
+}
+
+// Check verifies the embedded SCTs of the certificate chain and enforces the minimum number of distinct valid logs
+// The results of the single SCTs are returned as well, also if the check fails.
+func Check(certs [][]byte, config common.CTConfiguration) ([]SCTResult, error) {
+	if config.LogListFile == "" {
+		return nil, nil
+	}
+	minSCTs := config.MinSCTs
+	if minSCTs == 0 {
+		minSCTs = defaultMinSCTs
+	}
+	if minSCTs < 0 {
+		return nil, fmt.Errorf("Invalid minimal number of SCTs %d", config.MinSCTs)
+	}
+	if len(certs) < 2 {
+		return nil, fmt.Errorf("SCT verification needs the issuer certificate in the chain")
+	}
+
+	logs, err := LoadLogList(config.LogListFile)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(certs[0])
+	if err != nil {
+		return nil, err
+	}
+	issuer, err := x509.ParseCertificate(certs[1])
+	if err != nil {
+		return nil, err
+	}
+
+	results, err := VerifyEmbeddedSCTs(leaf, issuer, logs)
+	if err != nil {
+		return nil, err
+	}
+
+	validLogs := map[[32]byte]bool{}
+	for _, result := range results {
+		entry := log.WithField("timestamp", result.Timestamp.UTC().Format(time.RFC3339))
+		if result.Log != nil {
+			entry = entry.WithField("log", result.Log.Description)
+		} else {
+			entry = entry.WithField("logid", base64.StdEncoding.EncodeToString(result.LogID[:]))
+		}
+		if result.Err != nil {
+			entry.Warnf("SCT verification failed: %s", result.Err.Error())
+			continue
+		}
+		entry.Info("SCT verified")
+		validLogs[result.LogID] = true
+	}
+
+	log.Infof("Certificate has %d valid SCTs from distinct logs (%d embedded)", len(validLogs), len(results))
+	if len(validLogs) < minSCTs {
+		return results, fmt.Errorf("Certificate has valid SCTs from %d distinct logs, %d required", len(validLogs), minSCTs)
+	}
+	return results, nil
+}
+
+// splitSCTList splits a TLS encoded SignedCertificateTimestampList (RFC 6962 3.3) into single SCTs
+func splitSCTList(sctList []byte) ([][]byte, error) {
+	if len(sctList) < 2 || int(binary.BigEndian.Uint16(sctList)) != len(sctList)-2 {
+		return nil, fmt.Errorf("Malformed SCT list")
+	}
+	sctList = sctList[2:]
+
+	scts := [][]byte{}
+	for len(sctList) > 0 {
+		if len(sctList) < 2 {
+			return nil, fmt.Errorf("Malformed SCT list")
+		}
+		length := int(binary.BigEndian.Uint16(sctList))
+		if len(sctList) < 2+length {
+			return nil, fmt.Errorf("Malformed SCT list")
+		}
+		scts = append(scts, sctList[2:2+length])
+		sctList = sctList[2+length:]
+	}
+	return scts, nil
+}
+
+// verifySCT parses one SCT and checks its signature over the precertificate entry
+func verifySCT(rawSCT, precertTBS []byte, issuerKeyHash [32]byte, logs map[[32]byte]*Log) SCTResult {
+	result := SCTResult{}
+
+	// version(1) log_id(32) timestamp(8) extensions(2+n) signature: hash(1) signature(1) length(2) signature(n)
+	if len(rawSCT) < 1+32+8+2 {
+		result.Err = fmt.Errorf("SCT too short")
+		return result
+	}
+	if rawSCT[0] != 0 {
+		result.Err = fmt.Errorf("Unsupported SCT version %d", rawSCT[0])
+		return result
+	}
+	copy(result.LogID[:], rawSCT[1:33])
+	timestamp := binary.BigEndian.Uint64(rawSCT[33:41])
+	result.Timestamp = time.Unix(0, int64(timestamp)*int64(time.Millisecond))
+
+	extensionsLength := int(binary.BigEndian.Uint16(rawSCT[41:43]))
+	if len(rawSCT) < 43+extensionsLength+4 {
+		result.Err = fmt.Errorf("SCT too short")
+		return result
+	}
+	extensions := rawSCT[43 : 43+extensionsLength]
+	signature := rawSCT[43+extensionsLength:]
+	hashAlgorithm, signatureAlgorithm := signature[0], signature[1]
+	signatureLength := int(binary.BigEndian.Uint16(signature[2:4]))
+	if len(signature) != 4+signatureLength {
+		result.Err = fmt.Errorf("Malformed SCT signature")
+		return result
+	}
+	signature = signature[4:]
+
+	result.Log = logs[result.LogID]
+	if result.Log == nil {
+		result.Err = fmt.Errorf("SCT from unknown log")
+		return result
+	}
+	if !result.Log.Trusted(result.Timestamp) {
+		result.Err = fmt.Errorf("SCT from %s log", result.Log.State)
+		return result
+	}
+	if result.Timestamp.After(time.Now().Add(time.Hour)) {
+		result.Err = fmt.Errorf("SCT timestamp lies in the future")
+		return result
+	}
+
+	// digitally-signed struct of RFC 6962 3.2 for a precert_entry
+	var signed bytes.Buffer
+	signed.WriteByte(0) // version v1
+	signed.WriteByte(0) // signature type certificate_timestamp
+	binary.Write(&signed, binary.BigEndian, timestamp)
+	signed.Write([]byte{0, 1}) // entry type precert_entry
+	signed.Write(issuerKeyHash[:])
+	signed.Write([]byte{byte(len(precertTBS) >> 16), byte(len(precertTBS) >> 8), byte(len(precertTBS))})
+	signed.Write(precertTBS)
+	binary.Write(&signed, binary.BigEndian, uint16(len(extensions)))
+	signed.Write(extensions)
+
+	if hashAlgorithm != 4 { // sha256
+		result.Err = fmt.Errorf("Unsupported SCT hash algorithm %d", hashAlgorithm)
+		return result
+	}
+	digest := sha256.Sum256(signed.Bytes())
+
+	switch key := result.Log.Key.(type) {
+	case *ecdsa.PublicKey:
+		if signatureAlgorithm != 3 || !ecdsa.VerifyASN1(key, digest[:], signature) {
+			result.Err = fmt.Errorf("Invalid SCT signature")
+		}
+	case *rsa.PublicKey:
+		if signatureAlgorithm != 1 || rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature) != nil {
+			result.Err = fmt.Errorf("Invalid SCT signature")
+		}
+	default:
+		result.Err = fmt.Errorf("Unsupported log key type")
+	}
+	return result
+}
+
+type tbsCertificate struct {
+	Raw                asn1.RawContent
+	Version            int `asn1:"optional,explicit,default:0,tag:0"`
+	SerialNumber       *big.Int
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Issuer             asn1.RawValue
+	Validity           asn1.RawValue
+	Subject            asn1.RawValue
+	PublicKey          asn1.RawValue
+	UniqueID           asn1.BitString   `asn1:"optional,tag:1"`
+	SubjectUniqueID    asn1.BitString   `asn1:"optional,tag:2"`
+	Extensions         []pkix.Extension `asn1:"optional,explicit,tag:3"`
+}
+
+// buildPrecertTBS reconstructs the TBSCertificate the log has signed by removing the SCT list extension
+func buildPrecertTBS(rawTBS []byte) ([]byte, error) {
+	var tbs tbsCertificate
+	rest, err := asn1.Unmarshal(rawTBS, &tbs)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) > 0 {
+		return nil, fmt.Errorf("Trailing data after TBSCertificate")
+	}
+
+	extensions := []pkix.Extension{}
+	for _, extension := range tbs.Extensions {
+		if !extension.Id.Equal(oidSCTList) {
+			extensions = append(extensions, extension)
+		}
+	}
+	tbs.Extensions = extensions
+	tbs.Raw = nil
+
+	return asn1.Marshal(tbs)
+}
@@ -0,0 +1,269 @@
+package ct
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"felix-hartmond.de/projects/certbutler/common"
+)
+
+// testLog is a generated certificate transparency log
+type testLog struct {
+	description string
+	key         *ecdsa.PrivateKey
+	state       string
+	stateSince  time.Time
+}
+
+func newTestLog(t *testing.T, description, state string, stateSince time.Time) *testLog {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testLog{description: description, key: key, state: state, stateSince: stateSince}
+}
+
+func (l *testLog) keyBytes(t *testing.T) []byte {
+	keyBytes, err := x509.MarshalPKIXPublicKey(&l.key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keyBytes
+}
+
+// testSCT describes an SCT embedded in a test certificate
+type testSCT struct {
+	log       *testLog
+	timestamp time.Time
+	signer    *ecdsa.PrivateKey // signs the SCT instead of the key of the log, e.g. to create an invalid signature
+}
+
+// sign creates a TLS encoded SCT (RFC 6962 3.2) for the precertificate
+func (sct testSCT) sign(t *testing.T, precertTBS []byte, issuerKeyHash [32]byte) []byte {
+	timestamp := uint64(sct.timestamp.UnixNano() / int64(time.Millisecond))
+	var signed bytes.Buffer
+	signed.Write([]byte{0, 0})
+	binary.Write(&signed, binary.BigEndian, timestamp)
+	signed.Write([]byte{0, 1})
+	signed.Write(issuerKeyHash[:])
+	signed.Write([]byte{byte(len(precertTBS) >> 16), byte(len(precertTBS) >> 8), byte(len(precertTBS))})
+	signed.Write(precertTBS)
+	signed.Write([]byte{0, 0}) // no extensions
+	digest := sha256.Sum256(signed.Bytes())
+
+	signer := sct.signer
+	if signer == nil {
+		signer = sct.log.key
+	}
+	signature, err := ecdsa.SignASN1(rand.Reader, signer, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id := sha256.Sum256(sct.log.keyBytes(t))
+	var raw bytes.Buffer
+	raw.WriteByte(0) // v1
+	raw.Write(id[:])
+	binary.Write(&raw, binary.BigEndian, timestamp)
+	raw.Write([]byte{0, 0})
+	raw.Write([]byte{4, 3}) // sha256, ecdsa
+	binary.Write(&raw, binary.BigEndian, uint16(len(signature)))
+	raw.Write(signature)
+	return raw.Bytes()
+}
+
+// newTestChain issues a certificate with the given embedded SCTs and returns it with its issuer
+func newTestChain(t *testing.T, scts []testSCT) [][]byte {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "example.com"},
+		DNSNames:     []string{"example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+	}
+	create := func(sctList []byte) *x509.Certificate {
+		value, err := asn1.Marshal(sctList)
+		if err != nil {
+			t.Fatal(err)
+		}
+		template.ExtraExtensions = []pkix.Extension{{Id: oidSCTList, Value: value}}
+		der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cert
+	}
+
+	// the logs sign the certificate without the SCT list, which is the same for every content of the extension
+	precertTBS, err := buildPrecertTBS(create([]byte{0, 0}).RawTBSCertificate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuerKeyHash := sha256.Sum256(ca.RawSubjectPublicKeyInfo)
+
+	var list bytes.Buffer
+	for _, sct := range scts {
+		raw := sct.sign(t, precertTBS, issuerKeyHash)
+		binary.Write(&list, binary.BigEndian, uint16(len(raw)))
+		list.Write(raw)
+	}
+	sctList := append([]byte{byte(list.Len() >> 8), byte(list.Len())}, list.Bytes()...)
+	return [][]byte{create(sctList).Raw, caDER}
+}
+
+// writeTestLogList writes the logs in the Google log list v3 format
+func writeTestLogList(t *testing.T, logs []*testLog) string {
+	type state struct {
+		Timestamp time.Time `json:"timestamp"`
+	}
+	type logEntry struct {
+		Description string           `json:"description"`
+		LogID       string           `json:"log_id"`
+		Key         string           `json:"key"`
+		State       map[string]state `json:"state,omitempty"`
+	}
+	entries := []logEntry{}
+	for _, l := range logs {
+		keyBytes := l.keyBytes(t)
+		id := sha256.Sum256(keyBytes)
+		entry := logEntry{Description: l.description, LogID: base64.StdEncoding.EncodeToString(id[:]), Key: base64.StdEncoding.EncodeToString(keyBytes)}
+		if l.state != "" {
+			entry.State = map[string]state{l.state: {l.stateSince}}
+		}
+		entries = append(entries, entry)
+	}
+	list := map[string]interface{}{
+		"operators": []map[string]interface{}{{"name": "Test Operator", "logs": entries}},
+	}
+	listBytes, err := json.Marshal(list)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "certbutler-ct")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	filename := filepath.Join(dir, "log_list.json")
+	if err = ioutil.WriteFile(filename, listBytes, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestCheck(t *testing.T) {
+	now := time.Now()
+	usable1 := newTestLog(t, "Usable 1", "usable", now.Add(-24*time.Hour))
+	usable2 := newTestLog(t, "Usable 2", "usable", now.Add(-24*time.Hour))
+	noState := newTestLog(t, "Without state", "", time.Time{})
+	retired := newTestLog(t, "Retired", "retired", now.Add(-24*time.Hour))
+	retiredLater := newTestLog(t, "Retired later", "retired", now.Add(time.Hour))
+	rejected := newTestLog(t, "Rejected", "rejected", now.Add(-24*time.Hour))
+	pending := newTestLog(t, "Pending", "pending", now.Add(-24*time.Hour))
+	unlisted := newTestLog(t, "Unlisted", "usable", now.Add(-24*time.Hour))
+	listed := []*testLog{usable1, usable2, noState, retired, retiredLater, rejected, pending}
+
+	tests := []struct {
+		name      string
+		scts      []testSCT
+		minSCTs   int
+		wantValid int // number of valid SCTs in the results
+		wantErr   bool
+	}{
+		{"two usable logs", []testSCT{{log: usable1, timestamp: now}, {log: usable2, timestamp: now}}, 0, 2, false},
+		{"one log is not enough by default", []testSCT{{log: usable1, timestamp: now}}, 0, 1, true},
+		{"one log with lower minimum", []testSCT{{log: usable1, timestamp: now}}, 1, 1, false},
+		{"same log twice", []testSCT{{log: usable1, timestamp: now}, {log: usable1, timestamp: now}}, 0, 2, true},
+		{"log without state", []testSCT{{log: usable1, timestamp: now}, {log: noState, timestamp: now}}, 0, 2, false},
+		{"retired log", []testSCT{{log: usable1, timestamp: now}, {log: retired, timestamp: now}}, 0, 1, true},
+		{"SCT before retirement", []testSCT{{log: usable1, timestamp: now}, {log: retiredLater, timestamp: now}}, 0, 2, false},
+		{"rejected log", []testSCT{{log: usable1, timestamp: now}, {log: rejected, timestamp: now}}, 0, 1, true},
+		{"pending log", []testSCT{{log: usable1, timestamp: now}, {log: pending, timestamp: now}}, 0, 1, true},
+		{"unknown log", []testSCT{{log: usable1, timestamp: now}, {log: unlisted, timestamp: now}}, 0, 1, true},
+		{"invalid signature", []testSCT{{log: usable1, timestamp: now}, {log: usable2, timestamp: now, signer: unlisted.key}}, 0, 1, true},
+		{"timestamp in the future", []testSCT{{log: usable1, timestamp: now}, {log: usable2, timestamp: now.Add(2 * time.Hour)}}, 0, 1, true},
+	}
+	logList := writeTestLogList(t, listed)
+	for _, test := range tests {
+		results, err := Check(newTestChain(t, test.scts), common.CTConfiguration{LogListFile: logList, MinSCTs: test.minSCTs})
+		if test.wantErr && err == nil {
+			t.Errorf("%s: Check succeeded", test.name)
+		} else if !test.wantErr && err != nil {
+			t.Errorf("%s: Check failed: %v", test.name, err)
+		}
+
+		if len(results) != len(test.scts) {
+			t.Errorf("%s: Check returned %d results, want %d", test.name, len(results), len(test.scts))
+			continue
+		}
+		valid := 0
+		for _, result := range results {
+			if result.Err == nil {
+				valid++
+			}
+		}
+		if valid != test.wantValid {
+			t.Errorf("%s: %d SCTs are valid, want %d: %v", test.name, valid, test.wantValid, results)
+		}
+	}
+}
+
+func TestCheckConfiguration(t *testing.T) {
+	if results, err := Check(nil, common.CTConfiguration{}); err != nil || results != nil {
+		t.Errorf("Check without log list returned %v, %v", results, err)
+	}
+
+	logList := writeTestLogList(t, nil)
+	chain := newTestChain(t, nil)
+	if _, err := Check(chain, common.CTConfiguration{LogListFile: logList, MinSCTs: -1}); err == nil {
+		t.Error("Check with a negative minimum succeeded")
+	}
+	if _, err := Check(chain[:1], common.CTConfiguration{LogListFile: logList}); err == nil {
+		t.Error("Check without issuer succeeded")
+	}
+}
@@ -4,9 +4,10 @@ go 1.14
 
 require (
 	github.com/miekg/dns v1.1.35
+	github.com/robfig/cron/v3 v3.0.1
 	github.com/sirupsen/logrus v1.7.0
-	golang.org/x/crypto v0.0.0-20201112155050-0c6587e931a9
-	golang.org/x/net v0.0.0-20201110031124-69a78807bb2b // indirect
-	golang.org/x/sys v0.0.0-20201113233024-12cec1faf1ba // indirect
+	golang.org/x/crypto v0.0.0-20220331220935-ae2d96664a29
+	golang.org/x/sys v0.0.0-20210615035016-665e8c7367d1
 	gopkg.in/yaml.v3 v3.0.0-20200615113413-eeeca48fe776
+	software.sslmate.com/src/go-pkcs12 v0.2.0
 )
@@ -10,27 +10,55 @@ import (
 
 	"felix-hartmond.de/projects/certbutler/common"
 	"felix-hartmond.de/projects/certbutler/scheduler"
+	"felix-hartmond.de/projects/certbutler/state"
 	"gopkg.in/yaml.v3"
 )
 
 func main() {
+	filenames := getConfigFiles()
+	configs, err := loadConfigs(filenames)
+	if err != nil {
+		panic(err)
+	}
+
+	reload := func() ([]common.Config, error) {
+		return loadConfigs(filenames)
+	}
+	if err := scheduler.RunConfig(configs, reload); err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+}
+
+func loadConfigs(filenames []string) ([]common.Config, error) {
 	configs := []common.Config{}
-	for _, filename := range getConfigFiles() {
+	for _, filename := range filenames {
 		log.Printf("Parsing config: %s", filename)
 		yamlBytes, err := ioutil.ReadFile(filename)
 		if err != nil {
-			panic(err)
+			return nil, err
 		}
 
 		var config common.Config
 		err = yaml.Unmarshal(yamlBytes, &config)
 		if err != nil {
-			panic(err)
+			return nil, fmt.Errorf("Parsing config %s failed: %v", filename, err)
+		}
+		if config.Name == "" {
+			config.Name = filename
+		}
+		for _, other := range configs {
+			if other.Name == config.Name {
+				return nil, fmt.Errorf("Config name %s is used more than once", config.Name)
+			}
+			if config.State.Directory != "" && other.State.Directory != "" &&
+				state.Filename(config.State.Directory, config.Name) == state.Filename(other.State.Directory, other.Name) {
+				return nil, fmt.Errorf("Config names %s and %s share the state file %s", other.Name, config.Name, state.Filename(config.State.Directory, config.Name))
+			}
 		}
 		configs = append(configs, config)
 	}
-
-	scheduler.RunConfig(configs)
+	return configs, nil
 }
 
 func getConfigFiles() []string {
@@ -0,0 +1,86 @@
+package ocsp
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"felix-hartmond.de/projects/certbutler/common"
+)
+
+const (
+	defaultTimeout = 10 * time.Second
+	maxGETRequest  = 255 // RFC 5019: requests up to this size (base64 and url encoded) should be sent via GET
+)
+
+// newHTTPClient creates the http client for responder and issuer requests from the configuration
+func newHTTPClient(ocspConfig common.OCSPConfiguration) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	if ocspConfig.Proxy != "" {
+		proxyURL, err := url.Parse(ocspConfig.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid OCSP proxy %s: %v", ocspConfig.Proxy, err)
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	if ocspConfig.CACertFile != "" {
+		caBytes, err := ioutil.ReadFile(ocspConfig.CACertFile)
+		if err != nil {
+			return nil, err
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(caBytes) {
+			return nil, fmt.Errorf("No certificates found in %s", ocspConfig.CACertFile)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: roots}
+	}
+
+	timeout := defaultTimeout
+	if ocspConfig.TimeoutSeconds > 0 {
+		timeout = time.Duration(ocspConfig.TimeoutSeconds) * time.Second
+	}
+
+	return &http.Client{Timeout: timeout, Transport: transport}, nil
+}
+
+// responderURLs returns the configured responders or the ones from the certificate
+func responderURLs(cert *x509.Certificate, ocspConfig common.OCSPConfiguration) []string {
+	if len(ocspConfig.Responders) > 0 {
+		return ocspConfig.Responders
+	}
+	return cert.OCSPServer
+}
+
+// sendRequest sends an OCSP request to one responder and returns the raw response
+// Small requests are sent as GET so that responses can be served by caches and CDNs.
+func sendRequest(client *http.Client, responder string, ocspRequest []byte) ([]byte, error) {
+	var httpResponse *http.Response
+	var err error
+
+	encoded := url.QueryEscape(base64.StdEncoding.EncodeToString(ocspRequest))
+	if len(encoded) <= maxGETRequest {
+		httpResponse, err = client.Get(strings.TrimRight(responder, "/") + "/" + encoded)
+	} else {
+		httpResponse, err = client.Post(responder, "application/ocsp-request", bytes.NewReader(ocspRequest))
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer httpResponse.Body.Close()
+
+	if httpResponse.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("OCSP responder %s returned status %d", responder, httpResponse.StatusCode)
+	}
+
+	return ioutil.ReadAll(io.LimitReader(httpResponse.Body, maxResponseSize))
+}
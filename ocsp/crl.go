@@ -0,0 +1,165 @@
+package ocsp
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"felix-hartmond.de/projects/certbutler/common"
+	"felix-hartmond.de/projects/certbutler/storage"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+const maxCRLSize = 10 << 20
+
+var (
+	crlCache    = map[string]*x509.RevocationList{}
+	crlCacheMux sync.Mutex
+
+	// certificates without CRL distribution point, which have been reported once
+	noCRLNoticed sync.Map
+)
+
+// CheckCRL checks the stored certificate against the CRLs from its CRL distribution points
+// A revoked certificate is reported as StatusError, like a revoked OCSP status.
+func CheckCRL(store storage.Storage, ocspConfig common.OCSPConfiguration, crlConfig common.CRLConfiguration) error {
+	client, err := newHTTPClient(ocspConfig)
+	if err != nil {
+		return err
+	}
+
+	cert, issueCert, err := loadCertAndIssuer(store, ocspConfig, client)
+	if err != nil {
+		return err
+	}
+	if len(cert.CRLDistributionPoints) == 0 {
+		if _, noticed := noCRLNoticed.LoadOrStore(cert.SerialNumber.String(), true); !noticed {
+			log.Infof("Certificate %s contains no CRL distribution point, skipping CRL check", cert.Subject)
+		}
+		return nil
+	}
+
+	var lastErr error
+	for _, url := range cert.CRLDistributionPoints {
+		crl, err := getCRL(client, url, issueCert, crlConfig.CacheDir)
+		if err != nil {
+			log.Warnf("Loading CRL from %s failed with error %s", url, err.Error())
+			lastErr = err
+			continue
+		}
+
+		for _, revoked := range crl.RevokedCertificateEntries {
+			if revoked.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+				return &StatusError{Status: ocsp.Revoked, RevokedAt: revoked.RevocationTime}
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("No valid CRL available: %v", lastErr)
+}
+
+// getCRL returns the CRL from the cache or downloads it. CRLs are cached in memory and the cache directory until their next update.
+func getCRL(client *http.Client, url string, issueCert *x509.Certificate, cacheDir string) (*x509.RevocationList, error) {
+	crlCacheMux.Lock()
+	cached, ok := crlCache[url]
+	crlCacheMux.Unlock()
+	if ok && verifyCRL(cached, issueCert) == nil {
+		return cached, nil
+	}
+
+	cacheFile := ""
+	if cacheDir != "" {
+		hash := sha256.Sum256([]byte(url))
+		cacheFile = filepath.Join(cacheDir, hex.EncodeToString(hash[:])+".crl")
+		if raw, err := ioutil.ReadFile(cacheFile); err == nil {
+			if crl, err := parseAndVerifyCRL(raw, issueCert); err == nil {
+				storeCRL(url, crl)
+				return crl, nil
+			}
+		}
+	}
+
+	log.Infof("Downloading CRL from %s", url)
+	response, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned status %d", url, response.StatusCode)
+	}
+	raw, err := ioutil.ReadAll(io.LimitReader(response.Body, maxCRLSize))
+	if err != nil {
+		return nil, err
+	}
+
+	crl, err := parseAndVerifyCRL(raw, issueCert)
+	if err != nil {
+		return nil, err
+	}
+	storeCRL(url, crl)
+
+	if cacheFile != "" {
+		if err = os.MkdirAll(cacheDir, 0755); err == nil {
+			err = common.WriteFileAtomic(cacheFile, raw, common.FilePermissions{})
+		}
+		if err != nil {
+			log.Warnf("Caching CRL failed with error %s", err.Error())
+		}
+	}
+	return crl, nil
+}
+
+func storeCRL(url string, crl *x509.RevocationList) {
+	crlCacheMux.Lock()
+	crlCache[url] = crl
+	crlCacheMux.Unlock()
+}
+
+// parseAndVerifyCRL parses a DER or PEM encoded CRL and verifies it
+func parseAndVerifyCRL(raw []byte, issueCert *x509.Certificate) (*x509.RevocationList, error) {
+	if block, _ := pem.Decode(raw); block != nil && block.Type == "X509 CRL" {
+		raw = block.Bytes
+	}
+	crl, err := x509.ParseRevocationList(raw)
+	if err != nil {
+		return nil, fmt.Errorf("Parsing CRL failed: %v", err)
+	}
+	if err = verifyCRL(crl, issueCert); err != nil {
+		return nil, err
+	}
+	return crl, nil
+}
+
+// verifyCRL checks that the CRL is issued and signed by the issuer and is currently valid
+func verifyCRL(crl *x509.RevocationList, issueCert *x509.Certificate) error {
+	if !bytes.Equal(crl.RawIssuer, issueCert.RawSubject) {
+		return fmt.Errorf("CRL is not issued by %s", issueCert.Subject)
+	}
+	if err := crl.CheckSignatureFrom(issueCert); err != nil {
+		return fmt.Errorf("CRL signature is invalid: %v", err)
+	}
+
+	now := time.Now()
+	if crl.ThisUpdate.After(now.Add(maxClockSkew)) {
+		return fmt.Errorf("CRL is not valid before %s", crl.ThisUpdate)
+	}
+	if crl.NextUpdate.IsZero() || !crl.NextUpdate.After(now) {
+		return fmt.Errorf("CRL is stale since %s", crl.NextUpdate)
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package ocsp
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"felix-hartmond.de/projects/certbutler/common"
+	"felix-hartmond.de/projects/certbutler/storage"
+)
+
+// crl creates a CRL of the CA listing the revoked serials
+func (ca *testCA) crl(t *testing.T, thisUpdate, nextUpdate time.Time, revoked ...*big.Int) []byte {
+	template := &x509.RevocationList{
+		Number:     big.NewInt(1),
+		ThisUpdate: thisUpdate,
+		NextUpdate: nextUpdate,
+	}
+	for _, serial := range revoked {
+		template.RevokedCertificateEntries = append(template.RevokedCertificateEntries, x509.RevocationListEntry{SerialNumber: serial, RevocationTime: thisUpdate})
+	}
+	raw, err := x509.CreateRevocationList(rand.Reader, template, ca.cert, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
+
+func TestParseAndVerifyCRL(t *testing.T) {
+	ca := newTestCA(t, "Test CA")
+	otherCA := newTestCA(t, "Other CA")
+	sameNameCA := newTestCA(t, "Test CA") // same subject, different key
+
+	now := time.Now()
+	valid := ca.crl(t, now.Add(-time.Hour), now.Add(time.Hour))
+	tests := []struct {
+		name    string
+		raw     []byte
+		wantErr bool
+	}{
+		{"valid", valid, false},
+		{"pem", pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: valid}), false},
+		{"stale", ca.crl(t, now.Add(-2*time.Hour), now.Add(-time.Hour)), true},
+		{"not yet valid", ca.crl(t, now.Add(time.Hour), now.Add(2*time.Hour)), true},
+		{"wrong issuer", otherCA.crl(t, now.Add(-time.Hour), now.Add(time.Hour)), true},
+		{"wrong signature", sameNameCA.crl(t, now.Add(-time.Hour), now.Add(time.Hour)), true},
+		{"garbage", []byte("not a crl"), true},
+	}
+	for _, test := range tests {
+		_, err := parseAndVerifyCRL(test.raw, ca.cert)
+		if test.wantErr && err == nil {
+			t.Errorf("%s: CRL was accepted", test.name)
+		} else if !test.wantErr && err != nil {
+			t.Errorf("%s: parseAndVerifyCRL failed: %v", test.name, err)
+		}
+	}
+}
+
+func TestCheckCRL(t *testing.T) {
+	ca := newTestCA(t, "Test CA")
+	otherCA := newTestCA(t, "Other CA")
+	now := time.Now()
+
+	tests := []struct {
+		name        string
+		crl         func(serial *big.Int) []byte
+		wantRevoked bool
+		wantErr     bool
+	}{
+		{"not revoked", func(serial *big.Int) []byte {
+			return ca.crl(t, now.Add(-time.Hour), now.Add(time.Hour), big.NewInt(1000))
+		}, false, false},
+		{"revoked", func(serial *big.Int) []byte {
+			return ca.crl(t, now.Add(-time.Hour), now.Add(time.Hour), big.NewInt(1000), serial)
+		}, true, false},
+		{"stale", func(serial *big.Int) []byte {
+			return ca.crl(t, now.Add(-2*time.Hour), now.Add(-time.Hour), serial)
+		}, false, true},
+		{"wrong issuer", func(serial *big.Int) []byte {
+			return otherCA.crl(t, now.Add(-time.Hour), now.Add(time.Hour), serial)
+		}, false, true},
+	}
+	for i, test := range tests {
+		var crl []byte
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.Write(crl) }))
+		defer server.Close()
+
+		key := newTestKey(t)
+		cert := ca.issue(t, int64(100+i), &x509.Certificate{CRLDistributionPoints: []string{server.URL + "/ca.crl"}}, key)
+		crl = test.crl(cert.SerialNumber)
+		store := newTestStore(t, [][]byte{cert.Raw, ca.cert.Raw}, key)
+
+		err := CheckCRL(store, common.OCSPConfiguration{}, common.CRLConfiguration{Enabled: true})
+		statusErr, isStatusErr := err.(*StatusError)
+		switch {
+		case test.wantRevoked:
+			if !isStatusErr || !statusErr.Revoked() {
+				t.Errorf("%s: CheckCRL returned %v, want revoked", test.name, err)
+			}
+		case test.wantErr:
+			if err == nil || isStatusErr {
+				t.Errorf("%s: CheckCRL returned %v, want an error", test.name, err)
+			}
+		default:
+			if err != nil {
+				t.Errorf("%s: CheckCRL failed: %v", test.name, err)
+			}
+		}
+	}
+}
+
+// newTestStore stores the chain in a temporary directory
+func newTestStore(t *testing.T, certs [][]byte, key *ecdsa.PrivateKey) storage.Storage {
+	dir, err := ioutil.TempDir("", "certbutler-ocsp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	store := storage.NewFileStorage(common.FilesConfiguration{CertFile: filepath.Join(dir, "cert.pem"), KeyFile: filepath.Join(dir, "key.pem")}, "")
+	if err = store.PutCertificate(certs, key); err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
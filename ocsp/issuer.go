@@ -0,0 +1,151 @@
+package ocsp
+
+import (
+	"crypto/x509"
+	"encoding/asn1"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+
+	"felix-hartmond.de/projects/certbutler/common"
+	"felix-hartmond.de/projects/certbutler/storage"
+)
+
+const maxIssuerSize = 1 << 20
+
+var (
+	issuerCache    = map[string]*x509.Certificate{}
+	issuerCacheMux sync.Mutex
+)
+
+// pkcs7 structures to extract certificates from certs-only messages (.p7c) served by some CAs
+type pkcs7ContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"explicit,optional,tag:0"`
+}
+
+type pkcs7SignedData struct {
+	Version          int
+	DigestAlgorithms asn1.RawValue
+	ContentInfo      asn1.RawValue
+	Certificates     asn1.RawValue `asn1:"optional,tag:0"`
+}
+
+// loadCertAndIssuer loads the certificate from the storage and determines its issuer
+// The issuer is taken from the stored chain, the configured issuer file or the leaf's AIA caIssuers URL (in this order).
+func loadCertAndIssuer(store storage.Storage, ocspConfig common.OCSPConfiguration, client *http.Client) (*x509.Certificate, *x509.Certificate, error) {
+	bundle, err := store.GetCertificate()
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := bundle.Leaf()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if issueCert := bundle.Issuer(cert); issueCert != nil {
+		return cert, issueCert, nil
+	}
+
+	if ocspConfig.IssuerFile != "" {
+		issuerBundle, err := common.LoadBundle(ocspConfig.IssuerFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Loading issuer file failed: %v", err)
+		}
+		if issueCert := findIssuer(cert, issuerBundle.Certificates); issueCert != nil {
+			return cert, issueCert, nil
+		}
+		return nil, nil, fmt.Errorf("Issuer file %s does not contain the issuer of the certificate", ocspConfig.IssuerFile)
+	}
+
+	issueCert, err := fetchIssuer(cert, client)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cert, issueCert, nil
+}
+
+// fetchIssuer downloads the issuer certificate from the AIA caIssuers URLs of the certificate. Fetched issuers are cached.
+func fetchIssuer(cert *x509.Certificate, client *http.Client) (*x509.Certificate, error) {
+	if len(cert.IssuingCertificateURL) == 0 {
+		return nil, fmt.Errorf("Issuer certificate is not available and the certificate has no caIssuers URL")
+	}
+
+	var lastErr error
+	for _, url := range cert.IssuingCertificateURL {
+		issuerCacheMux.Lock()
+		cached, ok := issuerCache[url]
+		issuerCacheMux.Unlock()
+		if ok && cert.CheckSignatureFrom(cached) == nil {
+			return cached, nil
+		}
+
+		log.Infof("Fetching issuer certificate from %s", url)
+		candidates, err := downloadCertificates(client, url)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		issueCert := findIssuer(cert, candidates)
+		if issueCert == nil {
+			lastErr = fmt.Errorf("Certificate from %s is not the issuer", url)
+			continue
+		}
+
+		issuerCacheMux.Lock()
+		issuerCache[url] = issueCert
+		issuerCacheMux.Unlock()
+		return issueCert, nil
+	}
+	return nil, fmt.Errorf("Fetching issuer certificate failed: %v", lastErr)
+}
+
+// downloadCertificates fetches certificates in DER, PEM or PKCS#7 format from a URL
+func downloadCertificates(client *http.Client, url string) ([]*x509.Certificate, error) {
+	response, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned status %d", url, response.StatusCode)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(response.Body, maxIssuerSize))
+	if err != nil {
+		return nil, err
+	}
+	return parseCertificates(body)
+}
+
+// parseCertificates parses DER, PEM or PKCS#7 encoded certificates
+func parseCertificates(data []byte) ([]*x509.Certificate, error) {
+	if cert, err := x509.ParseCertificate(data); err == nil {
+		return []*x509.Certificate{cert}, nil
+	}
+	if bundle, err := common.ParseBundle(data); err == nil && len(bundle.Certificates) > 0 {
+		return bundle.Certificates, nil
+	}
+
+	var contentInfo pkcs7ContentInfo
+	if _, err := asn1.Unmarshal(data, &contentInfo); err == nil && len(contentInfo.Content.Bytes) > 0 {
+		var signedData pkcs7SignedData
+		if _, err := asn1.Unmarshal(contentInfo.Content.Bytes, &signedData); err == nil {
+			return x509.ParseCertificates(signedData.Certificates.Bytes)
+		}
+	}
+	return nil, fmt.Errorf("No certificates found")
+}
+
+func findIssuer(cert *x509.Certificate, candidates []*x509.Certificate) *x509.Certificate {
+	for _, candidate := range candidates {
+		if cert.CheckSignatureFrom(candidate) == nil {
+			return candidate
+		}
+	}
+	return nil
+}
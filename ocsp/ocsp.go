@@ -1,69 +1,137 @@
 package ocsp
 
 import (
-	"bytes"
-	"io/ioutil"
-	"net/http"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"sync"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 
 	"felix-hartmond.de/projects/certbutler/common"
+	"felix-hartmond.de/projects/certbutler/storage"
 
 	"golang.org/x/crypto/ocsp"
 )
 
+const (
+	maxClockSkew    = 5 * time.Minute
+	maxResponseSize = 1 << 20
+)
+
+// ErrNoResponder is returned if the certificate has no OCSP responder URL and no responders are configured
+var ErrNoResponder = errors.New("Certificate contains no OCSP responder URL and no responders are configured")
+
+// certificates without OCSP responder, which have been reported once
+var noResponderNoticed sync.Map
+
+// StatusError is returned when the responder reports the certificate as revoked or unknown
+type StatusError struct {
+	Status    int
+	RevokedAt time.Time
+}
+
+func (e *StatusError) Error() string {
+	if e.Status == ocsp.Revoked {
+		return fmt.Sprintf("Certificate is revoked since %s", e.RevokedAt)
+	}
+	return "Certificate status is unknown to the responder"
+}
+
+// Revoked returns whether the certificate is revoked; otherwise its status is unknown
+func (e *StatusError) Revoked() bool {
+	return e.Status == ocsp.Revoked
+}
+
+// StatusName returns the OCSP status as text
+func (e *StatusError) StatusName() string {
+	if e.Revoked() {
+		return "revoked"
+	}
+	return "unknown"
+}
+
 // GetOCSPResponse gathers a new OCSP response for stapling
-func GetOCSPResponse(certfile string) ([]byte, error) {
+// All responders are tried in order. A response is only returned if it is valid for the stored certificate, so a bad response never replaces the previous one.
+func GetOCSPResponse(store storage.Storage, ocspConfig common.OCSPConfiguration) ([]byte, error) {
 	log.Println("Requesting new OCSP response")
-	cert, err := common.LoadCertFromPEMFile(certfile, 0)
+	client, err := newHTTPClient(ocspConfig)
 	if err != nil {
 		return nil, err
 	}
 
-	issueCert, err := common.LoadCertFromPEMFile(certfile, 1)
+	cert, issueCert, err := loadCertAndIssuer(store, ocspConfig, client)
 	if err != nil {
 		return nil, err
 	}
 
-	ocspRequest, err := ocsp.CreateRequest(cert, issueCert, nil)
-	if err != nil {
-		return nil, err
+	responders := responderURLs(cert, ocspConfig)
+	if len(responders) == 0 {
+		return nil, ErrNoResponder
 	}
 
-	httpResponse, err := http.Post(cert.OCSPServer[0], "application/ocsp-request", bytes.NewBuffer(ocspRequest))
+	ocspRequest, err := ocsp.CreateRequest(cert, issueCert, nil)
 	if err != nil {
 		return nil, err
 	}
 
-	defer httpResponse.Body.Close()
+	var lastErr error
+	for _, responder := range responders {
+		ocspResponseRaw, err := sendRequest(client, responder, ocspRequest)
+		if err != nil {
+			log.Warnf("Requesting OCSP response from %s failed with error %s", responder, err.Error())
+			lastErr = err
+			continue
+		}
+
+		if _, err = parseAndVerify(ocspResponseRaw, cert, issueCert); err != nil {
+			if _, ok := err.(*StatusError); ok {
+				return nil, err
+			}
+			log.Warnf("Invalid OCSP response from %s: %s", responder, err.Error())
+			lastErr = fmt.Errorf("Invalid OCSP response from %s: %v", responder, err)
+			continue
+		}
+
+		return ocspResponseRaw, nil
+	}
+	return nil, lastErr
+}
 
-	ocspResponseRaw, err := ioutil.ReadAll(httpResponse.Body)
+// Load loads, parses and verifies the stored OCSP Response
+func Load(store storage.Storage, ocspConfig common.OCSPConfiguration) (*ocsp.Response, error) {
+	rawOCSPBytes, err := store.GetOCSP()
 	if err != nil {
 		return nil, err
 	}
 
-	return ocspResponseRaw, nil
-}
-
-// LoadFromFile loads and parsesn an OCSP Response from a file
-func LoadFromFile(certFile string) (*ocsp.Response, error) {
-	rawOCSPBytes, err := ioutil.ReadFile(certFile + ".ocsp")
+	client, err := newHTTPClient(ocspConfig)
 	if err != nil {
 		return nil, err
 	}
 
-	issueCert, err := common.LoadCertFromPEMFile(certFile, 1)
+	cert, issueCert, err := loadCertAndIssuer(store, ocspConfig, client)
 	if err != nil {
 		return nil, err
 	}
 
-	return ocsp.ParseResponse(rawOCSPBytes, issueCert)
+	return parseAndVerify(rawOCSPBytes, cert, issueCert)
 }
 
 // CheckOCSPRenew checks if a prepared OCSP response exists and if it is still longer valid than renewaldueocsp from config
-func CheckOCSPRenew(certFile string, renewalDueOCSP int) bool {
-	ocsp, err := LoadFromFile(certFile)
+// Certificates without OCSP responder never need a response.
+func CheckOCSPRenew(store storage.Storage, ocspConfig common.OCSPConfiguration, renewalDueOCSP int) bool {
+	if bundle, err := store.GetCertificate(); err == nil {
+		if cert, err := bundle.Leaf(); err == nil && len(responderURLs(cert, ocspConfig)) == 0 {
+			if _, noticed := noResponderNoticed.LoadOrStore(cert.SerialNumber.String(), true); !noticed {
+				log.Infof("Certificate %s contains no OCSP responder URL, skipping OCSP", cert.Subject)
+			}
+			return false
+		}
+	}
+
+	ocsp, err := Load(store, ocspConfig)
 	if err != nil {
 		// ocsp missing or not valid => renew ocsp
 		return true
@@ -76,3 +144,43 @@ func CheckOCSPRenew(certFile string, renewalDueOCSP int) bool {
 
 	return false
 }
+
+// parseAndVerify parses an OCSP response for the certificate and checks that it is signed by the issuer (or a responder delegated by it),
+// reports the certificate as good and is currently valid
+func parseAndVerify(raw []byte, cert, issueCert *x509.Certificate) (*ocsp.Response, error) {
+	response, err := ocsp.ParseResponseForCert(raw, cert, issueCert)
+	if err != nil {
+		return nil, err
+	}
+	if response.Certificate != nil && !response.Certificate.Equal(issueCert) && !isOCSPSigner(response.Certificate) {
+		// the signature of the issuer only proves that the responder certificate was issued by the CA, not that it is delegated to sign responses
+		return nil, fmt.Errorf("Responder certificate %s is not authorized to sign OCSP responses", response.Certificate.Subject)
+	}
+
+	if response.Status != ocsp.Good {
+		return nil, &StatusError{Status: response.Status, RevokedAt: response.RevokedAt}
+	}
+
+	now := time.Now()
+	if response.ThisUpdate.After(now.Add(maxClockSkew)) {
+		return nil, fmt.Errorf("Response is not valid before %s", response.ThisUpdate)
+	}
+	if response.NextUpdate.IsZero() {
+		return nil, fmt.Errorf("Response has no next update time")
+	}
+	if !response.NextUpdate.After(now) {
+		return nil, fmt.Errorf("Response is stale since %s", response.NextUpdate)
+	}
+
+	return response, nil
+}
+
+// isOCSPSigner returns whether a certificate is delegated to sign OCSP responses (RFC 6960 4.2.2.2)
+func isOCSPSigner(cert *x509.Certificate) bool {
+	for _, usage := range cert.ExtKeyUsage {
+		if usage == x509.ExtKeyUsageOCSPSigning {
+			return true
+		}
+	}
+	return false
+}
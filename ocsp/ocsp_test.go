@@ -0,0 +1,155 @@
+package ocsp
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// testCA is a generated CA issuing test certificates, OCSP responses and CRLs
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestKey(t *testing.T) *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	key := newTestKey(t)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key}
+}
+
+// issue creates a certificate for example.com; template may set further fields like the CRL distribution points
+func (ca *testCA) issue(t *testing.T, serial int64, template *x509.Certificate, key *ecdsa.PrivateKey) *x509.Certificate {
+	if template == nil {
+		template = &x509.Certificate{}
+	}
+	template.SerialNumber = big.NewInt(serial)
+	template.Subject = pkix.Name{CommonName: "example.com"}
+	template.DNSNames = []string{"example.com"}
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(24 * time.Hour)
+	if key == nil {
+		key = newTestKey(t)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+// respond creates an OCSP response for the serial signed by the CA itself
+func (ca *testCA) respond(t *testing.T, serial *big.Int, status int, thisUpdate, nextUpdate time.Time) []byte {
+	return ca.respondAs(t, serial, status, thisUpdate, nextUpdate, ca.cert, ca.key)
+}
+
+// respondAs creates an OCSP response signed by the given responder, e.g. a delegated responder or a different CA
+func (ca *testCA) respondAs(t *testing.T, serial *big.Int, status int, thisUpdate, nextUpdate time.Time, responder *x509.Certificate, responderKey crypto.Signer) []byte {
+	template := ocsp.Response{
+		Status:       status,
+		SerialNumber: serial,
+		ThisUpdate:   thisUpdate,
+		NextUpdate:   nextUpdate,
+	}
+	if status == ocsp.Revoked {
+		template.RevokedAt = thisUpdate
+	}
+	if responder != ca.cert {
+		template.Certificate = responder
+	}
+	raw, err := ocsp.CreateResponse(ca.cert, responder, template, responderKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
+
+func TestParseAndVerify(t *testing.T) {
+	ca := newTestCA(t, "Test CA")
+	otherCA := newTestCA(t, "Other CA")
+	cert := ca.issue(t, 42, nil, nil)
+
+	responderKey := newTestKey(t)
+	responder := ca.issue(t, 43, &x509.Certificate{ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageOCSPSigning}}, responderKey)
+	undelegatedKey := newTestKey(t)
+	undelegated := ca.issue(t, 44, nil, undelegatedKey)
+
+	now := time.Now()
+	tests := []struct {
+		name        string
+		raw         []byte
+		wantStatus  int // checked if the response is rejected with a StatusError
+		wantErr     bool
+		wantRevoked bool
+	}{
+		{"good", ca.respond(t, cert.SerialNumber, ocsp.Good, now.Add(-time.Hour), now.Add(time.Hour)), 0, false, false},
+		{"delegated responder", ca.respondAs(t, cert.SerialNumber, ocsp.Good, now.Add(-time.Hour), now.Add(time.Hour), responder, responderKey), 0, false, false},
+		{"revoked", ca.respond(t, cert.SerialNumber, ocsp.Revoked, now.Add(-time.Hour), now.Add(time.Hour)), ocsp.Revoked, true, true},
+		{"unknown", ca.respond(t, cert.SerialNumber, ocsp.Unknown, now.Add(-time.Hour), now.Add(time.Hour)), ocsp.Unknown, true, false},
+		{"stale", ca.respond(t, cert.SerialNumber, ocsp.Good, now.Add(-2*time.Hour), now.Add(-time.Hour)), 0, true, false},
+		{"no next update", ca.respond(t, cert.SerialNumber, ocsp.Good, now.Add(-time.Hour), time.Time{}), 0, true, false},
+		{"not yet valid", ca.respond(t, cert.SerialNumber, ocsp.Good, now.Add(time.Hour), now.Add(2*time.Hour)), 0, true, false},
+		{"other serial", ca.respond(t, big.NewInt(99), ocsp.Good, now.Add(-time.Hour), now.Add(time.Hour)), 0, true, false},
+		{"wrong issuer", otherCA.respond(t, cert.SerialNumber, ocsp.Good, now.Add(-time.Hour), now.Add(time.Hour)), 0, true, false},
+		{"responder without ocsp signing", ca.respondAs(t, cert.SerialNumber, ocsp.Good, now.Add(-time.Hour), now.Add(time.Hour), undelegated, undelegatedKey), 0, true, false},
+		{"garbage", []byte("not an ocsp response"), 0, true, false},
+	}
+	for _, test := range tests {
+		response, err := parseAndVerify(test.raw, cert, ca.cert)
+		if !test.wantErr {
+			if err != nil {
+				t.Errorf("%s: parseAndVerify failed: %v", test.name, err)
+			} else if response.SerialNumber.Cmp(cert.SerialNumber) != 0 {
+				t.Errorf("%s: response has serial %v", test.name, response.SerialNumber)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("%s: parseAndVerify accepted the response", test.name)
+			continue
+		}
+		statusErr, isStatusErr := err.(*StatusError)
+		if test.wantStatus != 0 && (!isStatusErr || statusErr.Status != test.wantStatus) {
+			t.Errorf("%s: parseAndVerify returned %v, want status %d", test.name, err, test.wantStatus)
+		}
+		if isStatusErr && statusErr.Revoked() != test.wantRevoked {
+			t.Errorf("%s: Revoked() is %v", test.name, statusErr.Revoked())
+		}
+	}
+}
@@ -0,0 +1,264 @@
+package ocsp
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"felix-hartmond.de/projects/certbutler/common"
+	"felix-hartmond.de/projects/certbutler/storage"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+const (
+	serverReloadInterval = time.Minute
+	serverMaxBackoff     = 30 * time.Minute // longest time between reloads of a source which fails to load
+	maxRequestSize       = 10 << 10
+)
+
+// Server answers OCSP requests with the stored responses of the added configurations, like an RFC 6960 responder
+// Requests are matched by their CertID, so backend servers can use certbutler as stapling responder instead of the CA.
+// The stored responses are reloaded in the background, so slow storage backends or issuer lookups never delay requests.
+type Server struct {
+	server   *http.Server
+	mux      sync.Mutex
+	sources  []*serverSource
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// serverSource is one configuration served by the server. Only the reload loop writes it; requests read the current response.
+type serverSource struct {
+	store      storage.Storage
+	ocspConfig common.OCSPConfiguration
+
+	nextReload time.Time
+	failures   int // reloads failed in a row; each doubles the time until the next attempt
+
+	mux     sync.RWMutex
+	current *servedResponse // nil if no valid response is loaded
+}
+
+// servedResponse is a verified response together with the certificate it belongs to
+type servedResponse struct {
+	raw       []byte
+	response  *ocsp.Response
+	cert      *x509.Certificate
+	issueCert *x509.Certificate
+}
+
+type subjectPublicKeyInfo struct {
+	Algorithm pkix.AlgorithmIdentifier
+	PublicKey asn1.BitString
+}
+
+// NewServer creates a responder for the given listen address without configurations
+func NewServer(address string) *Server {
+	s := &Server{stop: make(chan struct{})}
+	s.server = &http.Server{Addr: address, Handler: s, ReadTimeout: 10 * time.Second, WriteTimeout: 10 * time.Second}
+	return s
+}
+
+// Add registers the stored OCSP response of a configuration to be served
+func (s *Server) Add(store storage.Storage, ocspConfig common.OCSPConfiguration) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.sources = append(s.sources, &serverSource{store: store, ocspConfig: ocspConfig})
+}
+
+// ListenAndServe loads the stored responses and serves OCSP requests until the server is shut down
+func (s *Server) ListenAndServe() error {
+	s.reloadAll()
+	go s.reloadLoop()
+
+	log.Infof("Serving OCSP responses on %s", s.server.Addr)
+	err := s.server.ListenAndServe()
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+// Shutdown stops the server after running requests are answered
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.stopOnce.Do(func() { close(s.stop) })
+	return s.server.Shutdown(ctx)
+}
+
+// ServeHTTP answers OCSP requests sent via GET (base64 encoded in the path) or POST
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var request *ocsp.Request
+	var err error
+	switch r.Method {
+	case http.MethodGet:
+		request, err = parseGETRequest(r.URL.Path)
+	case http.MethodPost:
+		var rawRequest []byte
+		if rawRequest, err = ioutil.ReadAll(io.LimitReader(r.Body, maxRequestSize)); err == nil {
+			request, err = ocsp.ParseRequest(rawRequest)
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		writeResponse(w, ocsp.MalformedRequestErrorResponse, nil)
+		return
+	}
+
+	raw, response := s.lookup(request)
+	if raw == nil {
+		log.Debugf("No OCSP response for serial %v available", request.SerialNumber)
+		writeResponse(w, ocsp.UnauthorizedErrorResponse, nil)
+		return
+	}
+	writeResponse(w, raw, response)
+}
+
+// parseGETRequest parses the base64 encoded request from the path. As base64 can contain slashes, the responder may be served under any prefix.
+func parseGETRequest(path string) (*ocsp.Request, error) {
+	path = strings.TrimPrefix(path, "/")
+	for {
+		if rawRequest, err := base64.StdEncoding.DecodeString(path); err == nil {
+			if request, err := ocsp.ParseRequest(rawRequest); err == nil {
+				return request, nil
+			}
+		}
+		i := strings.Index(path, "/")
+		if i < 0 {
+			return nil, fmt.Errorf("No OCSP request found in path")
+		}
+		path = path[i+1:]
+	}
+}
+
+// lookup returns the loaded response matching the CertID of the request
+func (s *Server) lookup(request *ocsp.Request) ([]byte, *ocsp.Response) {
+	s.mux.Lock()
+	sources := s.sources
+	s.mux.Unlock()
+
+	now := time.Now()
+	for _, source := range sources {
+		source.mux.RLock()
+		current := source.current
+		source.mux.RUnlock()
+
+		if current != nil && now.Before(current.response.NextUpdate) && current.matches(request) {
+			return current.raw, current.response
+		}
+	}
+	return nil, nil
+}
+
+// reloadLoop reloads the sources until the server is shut down
+func (s *Server) reloadLoop() {
+	ticker := time.NewTicker(serverReloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.reloadAll()
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// reloadAll reloads all sources which are due; the sources are not locked while loading
+func (s *Server) reloadAll() {
+	s.mux.Lock()
+	sources := s.sources
+	s.mux.Unlock()
+
+	now := time.Now()
+	for _, source := range sources {
+		if now.Before(source.nextReload) {
+			continue
+		}
+		if err := source.reload(); err != nil {
+			backoff := serverMaxBackoff
+			if source.failures < 10 && serverReloadInterval<<uint(source.failures) < serverMaxBackoff {
+				backoff = serverReloadInterval << uint(source.failures)
+			}
+			source.failures++
+			source.nextReload = now.Add(backoff)
+			log.Warnf("Loading OCSP response for serving failed with error %s - trying again in %s", err.Error(), backoff)
+			continue
+		}
+		source.failures = 0
+		source.nextReload = now.Add(serverReloadInterval)
+	}
+}
+
+// reload loads and verifies the stored response. If this fails, the previous response is served until it is stale.
+func (source *serverSource) reload() error {
+	client, err := newHTTPClient(source.ocspConfig)
+	if err != nil {
+		return err
+	}
+	cert, issueCert, err := loadCertAndIssuer(source.store, source.ocspConfig, client)
+	if err != nil {
+		return err
+	}
+	raw, err := source.store.GetOCSP()
+	if err != nil {
+		return err
+	}
+	response, err := parseAndVerify(raw, cert, issueCert)
+	if err != nil {
+		return err
+	}
+
+	source.mux.Lock()
+	source.current = &servedResponse{raw: raw, response: response, cert: cert, issueCert: issueCert}
+	source.mux.Unlock()
+	return nil
+}
+
+// matches compares the CertID of the request (serial, issuer name hash and issuer key hash) with the certificate of the response
+func (served *servedResponse) matches(request *ocsp.Request) bool {
+	if served.cert.SerialNumber.Cmp(request.SerialNumber) != 0 || !request.HashAlgorithm.Available() {
+		return false
+	}
+
+	var publicKeyInfo subjectPublicKeyInfo
+	if _, err := asn1.Unmarshal(served.issueCert.RawSubjectPublicKeyInfo, &publicKeyInfo); err != nil {
+		return false
+	}
+
+	return bytes.Equal(hash(request.HashAlgorithm, served.issueCert.RawSubject), request.IssuerNameHash) &&
+		bytes.Equal(hash(request.HashAlgorithm, publicKeyInfo.PublicKey.RightAlign()), request.IssuerKeyHash)
+}
+
+func hash(algorithm crypto.Hash, data []byte) []byte {
+	h := algorithm.New()
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+// writeResponse sends an OCSP response with caching headers as recommended by RFC 5019
+func writeResponse(w http.ResponseWriter, raw []byte, response *ocsp.Response) {
+	w.Header().Set("Content-Type", "application/ocsp-response")
+	if response != nil {
+		now := time.Now()
+		w.Header().Set("Last-Modified", response.ThisUpdate.UTC().Format(http.TimeFormat))
+		w.Header().Set("Expires", response.NextUpdate.UTC().Format(http.TimeFormat))
+		w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d, public, no-transform, must-revalidate", int(response.NextUpdate.Sub(now).Seconds())))
+	}
+	w.Write(raw)
+}
@@ -0,0 +1,143 @@
+package ocsp
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// newTestRequest creates a DER encoded OCSP request for the certificate
+func newTestRequest(t *testing.T, cert, issuer *x509.Certificate, hash crypto.Hash) []byte {
+	raw, err := ocsp.CreateRequest(cert, issuer, &ocsp.RequestOptions{Hash: hash})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
+
+func TestServedResponseMatches(t *testing.T) {
+	ca := newTestCA(t, "Test CA")
+	otherCA := newTestCA(t, "Other CA")
+	sameNameCA := newTestCA(t, "Test CA") // same subject, different key
+	cert := ca.issue(t, 42, nil, nil)
+	served := &servedResponse{cert: cert, issueCert: ca.cert}
+
+	tests := []struct {
+		name    string
+		request []byte
+		want    bool
+	}{
+		{"sha1", newTestRequest(t, cert, ca.cert, crypto.SHA1), true},
+		{"sha256", newTestRequest(t, cert, ca.cert, crypto.SHA256), true},
+		{"other serial", newTestRequest(t, ca.issue(t, 43, nil, nil), ca.cert, crypto.SHA1), false},
+		{"other issuer", newTestRequest(t, otherCA.issue(t, 42, nil, nil), otherCA.cert, crypto.SHA1), false},
+		{"issuer with same name", newTestRequest(t, sameNameCA.issue(t, 42, nil, nil), sameNameCA.cert, crypto.SHA1), false},
+	}
+	for _, test := range tests {
+		request, err := ocsp.ParseRequest(test.request)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if got := served.matches(request); got != test.want {
+			t.Errorf("%s: matches returned %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestParseGETRequest(t *testing.T) {
+	ca := newTestCA(t, "Test CA")
+
+	// find a request whose base64 encoding contains a slash, which must not be mistaken for the end of a prefix
+	var cert *x509.Certificate
+	var encoded string
+	for serial := int64(1); !strings.Contains(encoded, "/"); serial++ {
+		cert = ca.issue(t, serial, nil, nil)
+		encoded = base64.StdEncoding.EncodeToString(newTestRequest(t, cert, ca.cert, crypto.SHA1))
+	}
+
+	tests := []struct {
+		name    string
+		path    string
+		wantErr bool
+	}{
+		{"root", "/" + encoded, false},
+		{"prefix", "/ocsp/" + encoded, false},
+		{"nested prefix", "/a/b/c/" + encoded, false},
+		{"no leading slash", encoded, false},
+		{"no request", "/ocsp/", true},
+		{"garbage", "/ocsp/bm90IGEgcmVxdWVzdA==", true},
+		{"truncated", "/" + encoded[:len(encoded)/2], true},
+	}
+	for _, test := range tests {
+		request, err := parseGETRequest(test.path)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%s: parseGETRequest succeeded", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: parseGETRequest failed: %v", test.name, err)
+		} else if request.SerialNumber.Cmp(cert.SerialNumber) != 0 {
+			t.Errorf("%s: request has serial %v, want %v", test.name, request.SerialNumber, cert.SerialNumber)
+		}
+	}
+}
+
+func TestServerServeHTTP(t *testing.T) {
+	ca := newTestCA(t, "Test CA")
+	cert := ca.issue(t, 42, nil, nil)
+	now := time.Now()
+	raw := ca.respond(t, cert.SerialNumber, ocsp.Good, now.Add(-time.Hour), now.Add(time.Hour))
+	response, err := parseAndVerify(raw, cert, ca.cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewServer("")
+	s.sources = []*serverSource{{current: &servedResponse{raw: raw, response: response, cert: cert, issueCert: ca.cert}}}
+	server := httptest.NewServer(s)
+	defer server.Close()
+
+	request := newTestRequest(t, cert, ca.cert, crypto.SHA1)
+	unknown := newTestRequest(t, ca.issue(t, 43, nil, nil), ca.cert, crypto.SHA1)
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   []byte
+		want   []byte
+	}{
+		{"GET", http.MethodGet, "/ocsp/" + base64.StdEncoding.EncodeToString(request), nil, raw},
+		{"POST", http.MethodPost, "/", request, raw},
+		{"unknown certificate", http.MethodPost, "/", unknown, ocsp.UnauthorizedErrorResponse},
+		{"malformed", http.MethodPost, "/", []byte("garbage"), ocsp.MalformedRequestErrorResponse},
+	}
+	for _, test := range tests {
+		httpRequest, err := http.NewRequest(test.method, server.URL+test.path, bytes.NewReader(test.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		httpResponse, err := http.DefaultClient.Do(httpRequest)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		body, err := ioutil.ReadAll(httpResponse.Body)
+		httpResponse.Body.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if !bytes.Equal(body, test.want) {
+			t.Errorf("%s: server returned an unexpected response", test.name)
+		}
+	}
+}
@@ -14,7 +14,7 @@ import (
 
 // ProcessHaProxy sends the updated certificate and/or OCSP response to haproxy
 func ProcessHaProxy(haConfig common.HaProxyConfiguration, filesConfig common.FilesConfiguration, updateResult common.UpdateResultData) error {
-	if filesConfig.SingleFile == false {
+	if filesConfig.SingleFile == false && updateResult.Key != nil {
 		return fmt.Errorf("Updating haproxy aborted as certificate and key are stored in different files (option singleFile in configuration")
 	}
 
@@ -0,0 +1,101 @@
+package scheduler
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+
+	log "github.com/sirupsen/logrus"
+
+	"felix-hartmond.de/projects/certbutler/common"
+	"felix-hartmond.de/projects/certbutler/state"
+	"felix-hartmond.de/projects/certbutler/storage"
+)
+
+// follow deploys the certificate and OCSP response stored by the leader if they changed since the last deployment on this node
+func (r *runner) follow(ctx context.Context, store storage.Storage, result *Result, release func()) {
+	config := r.config
+
+	fingerprint, updateResultData, err := loadStored(store, config)
+	if err == storage.ErrNotFound {
+		log.Infof("Follower: no certificate for %s stored by the leader yet", config.Name)
+		return
+	}
+	if err != nil {
+		log.Warnf("Follower: loading stored certificate for %s failed with error %s", config.Name, err.Error())
+		result.fail(PhaseStorage, true, err)
+		return
+	}
+	if fingerprint == r.getDeployedFingerprint() && r.pending == nil {
+		log.Infof("Follower: stored certificate and OCSP response of %s unchanged, nothing to process", config.Name)
+		return
+	}
+	log.Infof("Follower: deploying certificate and OCSP response of %s stored by the leader", config.Name)
+
+	if config.Storage.Backend != "" && config.Storage.Backend != "file" && config.Storage.KeepLocalFiles {
+		// the leader only wrote its own local files
+		files := storage.NewFileStorage(config.Files, config.Certificate.AcmeAccountFile)
+		if updateResultData.Key != nil {
+			err = files.PutCertificate(updateResultData.Certificates, updateResultData.Key)
+		}
+		if err == nil && updateResultData.OCSPResponse != nil {
+			err = files.PutOCSP(updateResultData.OCSPResponse)
+		}
+		if err != nil {
+			log.Warnf("Follower: writing local files of %s failed with error %s", config.Name, err.Error())
+			result.fail(PhaseStorage, true, err)
+			return
+		}
+	}
+
+	if r.deploy(ctx, updateResultData, result, release) {
+		r.setDeployedFingerprint(fingerprint)
+	}
+}
+
+// loadStored loads certificate, key and OCSP response from the storage and returns them with a fingerprint of certificate and OCSP response
+func loadStored(store storage.Storage, config common.Config) (string, common.UpdateResultData, error) {
+	updateResultData := common.UpdateResultData{}
+
+	bundle, err := store.GetCertificate()
+	if err != nil {
+		return "", updateResultData, err
+	}
+	key, err := store.GetKey()
+	if err != nil && !config.OCSP.Only {
+		// certificates managed elsewhere may be stored without key
+		return "", updateResultData, err
+	}
+	ocspResponse, err := store.GetOCSP()
+	if err != nil && err != storage.ErrNotFound {
+		return "", updateResultData, err
+	}
+
+	hash := sha256.New()
+	for _, cert := range bundle.Certificates {
+		updateResultData.Certificates = append(updateResultData.Certificates, cert.Raw)
+		hash.Write(cert.Raw)
+	}
+	hash.Write(ocspResponse)
+	updateResultData.Key = key
+	updateResultData.OCSPResponse = ocspResponse
+
+	return hex.EncodeToString(hash.Sum(nil)), updateResultData, nil
+}
+
+func (r *runner) getDeployedFingerprint() string {
+	if r.state == nil {
+		return r.deployedFingerprint
+	}
+	s, err := r.state.Load()
+	if err != nil {
+		log.Warnf("Loading state of %s failed with error %s", r.config.Name, err.Error())
+		return ""
+	}
+	return s.DeployedFingerprint
+}
+
+func (r *runner) setDeployedFingerprint(fingerprint string) {
+	r.deployedFingerprint = fingerprint
+	r.recordState(func(s *state.State) { s.DeployedFingerprint = fingerprint })
+}
@@ -0,0 +1,107 @@
+package scheduler
+
+import (
+	"context"
+	"reflect"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	log "github.com/sirupsen/logrus"
+
+	"felix-hartmond.de/projects/certbutler/common"
+)
+
+// job runs one scheduled configuration until it is stopped
+type job struct {
+	config common.Config
+	runner *runner
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// jobSet holds the running jobs by configuration name
+type jobSet map[string]*job
+
+// startJob runs the configuration according to its schedule in the background
+func startJob(ctx context.Context, r *runner, schedule cron.Schedule) *job {
+	ctx, cancel := context.WithCancel(ctx)
+	j := &job{config: r.config, runner: r, cancel: cancel, done: make(chan struct{})}
+
+	go func() {
+		defer close(j.done)
+		if r.elector != nil {
+			// let another node take over without waiting for the lease to expire
+			defer func() {
+				if err := r.elector.Release(); err != nil {
+					log.Warnf("Releasing leadership for %s failed with error %s", r.config.Name, err.Error())
+				}
+			}()
+		}
+		next := time.Now()
+		if r.config.Timing.Schedule != "" {
+			// cron schedules wait for the first scheduled time, intervals start with a run
+			next = schedule.Next(next)
+		}
+		for {
+			if !sleepUntil(ctx, next.Add(jitter(r.config.Timing)), "Next run of "+r.config.Name) {
+				return
+			}
+			r.runWithRetries(ctx)
+			next = schedule.Next(time.Now())
+		}
+	}()
+	return j
+}
+
+// stop cancels the job and waits until a running run is finished
+func (j *job) stop() {
+	j.cancel()
+	<-j.done
+}
+
+// apply updates the jobs to the scheduled configurations: new ones are started, changed ones restarted and removed ones stopped
+func (jobs jobSet) apply(ctx context.Context, configs []common.Config) {
+	wanted := map[string]bool{}
+	for _, config := range configs {
+		if !scheduled(config) {
+			continue
+		}
+		wanted[config.Name] = true
+
+		existing, ok := jobs[config.Name]
+		if ok && reflect.DeepEqual(existing.config, config) {
+			continue
+		}
+
+		r, schedule, err := newRunner(config)
+		if ok {
+			log.Infof("Configuration %s changed, restarting its schedule", config.Name)
+			existing.stop()
+			delete(jobs, config.Name)
+		}
+		if err != nil {
+			continue
+		}
+		if ok && existing.runner.pending != nil {
+			// updates which are stored but not deployed yet must not get lost with the old runner
+			r.pending = existing.runner.pending
+		}
+		jobs[config.Name] = startJob(ctx, r, schedule)
+	}
+
+	for name, j := range jobs {
+		if !wanted[name] {
+			log.Infof("Configuration %s removed, stopping its schedule", name)
+			j.stop()
+			delete(jobs, name)
+		}
+	}
+}
+
+// stopAll stops all jobs
+func (jobs jobSet) stopAll() {
+	for name, j := range jobs {
+		j.stop()
+		delete(jobs, name)
+	}
+}
@@ -0,0 +1,78 @@
+package scheduler
+
+import (
+	"fmt"
+	"strings"
+
+	"felix-hartmond.de/projects/certbutler/ct"
+)
+
+// Phase names the step of a run in which a failure occurred
+type Phase string
+
+// Phases of a run
+const (
+	PhaseConfig      Phase = "config"
+	PhaseStorage     Phase = "storage"
+	PhaseCluster     Phase = "cluster"
+	PhaseCertificate Phase = "certificate"
+	PhaseRevocation  Phase = "revocation"
+	PhaseOCSP        Phase = "ocsp"
+	PhaseDeploy      Phase = "deploy"
+)
+
+// Failure describes one failed step of a run
+type Failure struct {
+	Phase     Phase
+	Err       error
+	Retryable bool // the step may succeed when the run is repeated
+}
+
+// Result holds the outcome of one run of a configuration
+type Result struct {
+	Name     string
+	Failures []Failure
+	Skipped  bool           // (part of) the run was skipped because another process held a lock
+	SCTs     []ct.SCTResult // verification results of the SCTs of a newly issued certificate
+}
+
+// Failed returns whether any step of the run failed
+func (r *Result) Failed() bool {
+	return len(r.Failures) > 0
+}
+
+// Retryable returns whether the run failed and repeating it may help
+func (r *Result) Retryable() bool {
+	for _, failure := range r.Failures {
+		if failure.Retryable {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Result) fail(phase Phase, retryable bool, err error) {
+	r.Failures = append(r.Failures, Failure{Phase: phase, Err: err, Retryable: retryable})
+}
+
+func (r *Result) String() string {
+	scts := ""
+	if len(r.SCTs) > 0 {
+		results := []string{}
+		for _, sct := range r.SCTs {
+			results = append(results, sct.String())
+		}
+		scts = fmt.Sprintf(" [SCTs: %s]", strings.Join(results, "; "))
+	}
+	if !r.Failed() {
+		if r.Skipped {
+			return fmt.Sprintf("%s: skipped", r.Name)
+		}
+		return fmt.Sprintf("%s: ok%s", r.Name, scts)
+	}
+	failures := []string{}
+	for _, failure := range r.Failures {
+		failures = append(failures, fmt.Sprintf("%s: %v", failure.Phase, failure.Err))
+	}
+	return fmt.Sprintf("%s: failed (%s)%s", r.Name, strings.Join(failures, "; "), scts)
+}
@@ -1,101 +1,425 @@
 package scheduler
 
 import (
-	"io/ioutil"
+	"context"
+	"crypto/x509"
+	"fmt"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"sync"
+	"syscall"
 	"time"
 
+	"github.com/robfig/cron/v3"
 	log "github.com/sirupsen/logrus"
 
 	"felix-hartmond.de/projects/certbutler/acme"
+	"felix-hartmond.de/projects/certbutler/cluster"
 	"felix-hartmond.de/projects/certbutler/common"
+	"felix-hartmond.de/projects/certbutler/ct"
 	"felix-hartmond.de/projects/certbutler/ocsp"
 	"felix-hartmond.de/projects/certbutler/postprocessing"
+	"felix-hartmond.de/projects/certbutler/state"
+	"felix-hartmond.de/projects/certbutler/storage"
+)
+
+const (
+	maxRetries = 3
+	retryDelay = 30 * time.Second
+	maxBackoff = 6 * time.Hour // longest back off between runs after failed runs
+
+	unknownGracePeriod = 24 * time.Hour // minimum age of a certificate reported as unknown before it is reissued
+	unknownReports     = 3              // consecutive unknown reports before a certificate is reissued
+)
+
+var (
+	accountLocks    = map[string]*sync.Mutex{}
+	accountLocksMux sync.Mutex
 )
 
 // RunConfig starts cerbutler tasked based on a configuration
-func RunConfig(configs []common.Config) {
-	wg := &sync.WaitGroup{}
+// Configurations without schedule run once; in pure one-shot mode an error summarizing all failed configurations is returned.
+// Scheduled configurations run until SIGINT or SIGTERM. On SIGHUP, reload is called and the schedules are updated.
+func RunConfig(configs []common.Config, reload func() ([]common.Config, error)) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-	for _, config := range configs {
-		c := config
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(signals)
+
+	servers := startOCSPServers(configs)
+	jobs := jobSet{}
+	jobs.apply(ctx, configs)
 
-		if config.HaProxy.HAProxySocket != "" && !config.Files.SingleFile {
-			log.Warn("HaProxy post-processor is enabled but certificate and key are stored in two files. This combination usually does not work.")
+	// one-shot configurations
+	wg := &sync.WaitGroup{}
+	results := []*Result{}
+	resultsMux := sync.Mutex{}
+	for _, config := range configs {
+		if scheduled(config) {
+			continue
+		}
+		r, _, err := newRunner(config)
+		if err != nil {
+			resultsMux.Lock()
+			results = append(results, &Result{Name: config.Name, Failures: []Failure{{Phase: PhaseConfig, Err: err}}})
+			resultsMux.Unlock()
+			continue
 		}
 
-		if config.Nginx.ReloadNginx && config.Files.SingleFile {
-			log.Warn("Nginx post-processor is enabled but certificate and key are stored in one combined file. This combination usually does not work.")
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if !sleepUntil(ctx, time.Now().Add(jitter(r.config.Timing)), "Run of "+r.config.Name+" delayed by jitter until") {
+				return
+			}
+			result := r.runWithRetries(ctx)
+			resultsMux.Lock()
+			results = append(results, result)
+			resultsMux.Unlock()
+		}()
+	}
+	oneShotDone := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(oneShotDone)
+	}()
+
+	var err error
+	for {
+		select {
+		case <-oneShotDone:
+			oneShotDone = nil
+			err = summarize(results)
+			if len(jobs) == 0 {
+				stopOCSPServers(servers)
+				return err
+			}
+		case sig := <-signals:
+			if sig == syscall.SIGHUP {
+				log.Info("Received SIGHUP, reloading configuration")
+				newConfigs, reloadErr := reload()
+				if reloadErr != nil {
+					log.Errorf("Reloading configuration failed with error %s - keeping the current configuration", reloadErr.Error())
+					continue
+				}
+				stopOCSPServers(servers)
+				servers = startOCSPServers(newConfigs)
+				jobs.apply(ctx, newConfigs)
+				continue
+			}
+
+			log.Infof("Received %s, shutting down", sig)
+			cancel()
+			jobs.stopAll()
+			wg.Wait()
+			stopOCSPServers(servers)
+			if oneShotDone != nil {
+				err = summarize(results)
+			}
+			return err
 		}
+	}
+}
 
-		if config.Timing.RunIntervalMinutes == 0 {
-			wg.Add(1)
-			go func() {
-				process(c)
-				wg.Done()
-			}()
+// scheduled returns whether the configuration runs repeatedly
+func scheduled(config common.Config) bool {
+	return config.Timing.Schedule != "" || config.Timing.RunIntervalMinutes > 0
+}
+
+// summarize logs the results of all one-shot runs and returns an error if any of them failed
+func summarize(results []*Result) error {
+	if len(results) == 0 {
+		return nil
+	}
+
+	failed := 0
+	log.Info("Summary:")
+	for _, result := range results {
+		if result.Failed() {
+			failed++
+			log.Error(result.String())
 		} else {
-			ticker := time.NewTicker(time.Duration(config.Timing.RunIntervalMinutes) * time.Minute)
-			wg.Add(1) // this will never be set to done -> runs indefinitely
-			go func(waitChannel <-chan time.Time, config common.Config) {
-				for {
-					process(c)
-					<-waitChannel
-				}
-			}(ticker.C, config)
+			log.Info(result.String())
 		}
 	}
-	wg.Wait()
+	if failed > 0 {
+		return fmt.Errorf("%d of %d configurations failed", failed, len(results))
+	}
+	return nil
 }
 
-func process(config common.Config) {
-	log.Info("Starting Run")
+// startOCSPServers starts the built-in OCSP responders. Configurations with the same listen address share one server.
+func startOCSPServers(configs []common.Config) []*ocsp.Server {
+	servers := map[string]*ocsp.Server{}
+	for _, config := range configs {
+		if config.OCSP.Listen == "" {
+			continue
+		}
+		store, err := storage.New(config)
+		if err != nil {
+			log.Errorf("Initializing storage for OCSP responder failed with error %s", err.Error())
+			continue
+		}
+		if servers[config.OCSP.Listen] == nil {
+			servers[config.OCSP.Listen] = ocsp.NewServer(config.OCSP.Listen)
+		}
+		servers[config.OCSP.Listen].Add(store, config.OCSP)
+	}
+
+	started := []*ocsp.Server{}
+	for address, server := range servers {
+		go func(address string, server *ocsp.Server) {
+			if err := server.ListenAndServe(); err != nil {
+				log.Errorf("OCSP responder on %s failed with error %s", address, err.Error())
+			}
+		}(address, server)
+		started = append(started, server)
+	}
+	return started
+}
 
-	updateResultData := common.UpdateResultData{}
+func stopOCSPServers(servers []*ocsp.Server) {
+	for _, server := range servers {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		if err := server.Shutdown(ctx); err != nil {
+			log.Warnf("Stopping OCSP responder failed with error %s", err.Error())
+		}
+		cancel()
+	}
+}
 
-	// check tasks for this run
-	needCert := config.Timing.RenewalDueCert > 0 && acme.CheckCertRenew(config.Files.CertFile, config.Timing.RenewalDueCert)               // has the certificate to be renewed?
-	needOCSP := config.Timing.RenewalDueOCSP > 0 && (needCert || ocsp.CheckOCSPRenew(config.Files.CertFile, config.Timing.RenewalDueOCSP)) // has ocsp to be renewed?
+// runner runs the tasks of one configuration and keeps staged updates whose deployment failed for the next run
+type runner struct {
+	config  common.Config
+	window  *window         // deployment window; nil allows deployment at any time
+	state   *state.Store    // nil if no state directory is configured
+	elector cluster.Elector // nil if not running in cluster mode
+	pending *common.UpdateResultData
 
-	if needCert {
-		log.Info("Certificate needs renewal")
+	pendingRestored     bool                // updates left pending by an earlier process have been restored from the state
+	deployedFingerprint string              // used in cluster mode if no state directory is configured
+	unknown             state.UnknownStatus // used if no state directory is configured
+}
+
+// newRunner checks a configuration and creates its runner and schedule; a nil schedule means a single run
+func newRunner(config common.Config) (*runner, cron.Schedule, error) {
+	if config.OCSP.Only && config.Timing.RenewalDueOCSP == 0 {
+		log.Warn("OCSP only mode is enabled but OCSP refresh is disabled (renewaldueocsp is 0). Nothing will be done for this configuration.")
+	}
+
+	if config.HaProxy.HAProxySocket != "" && !config.Files.SingleFile && !config.OCSP.Only {
+		log.Warn("HaProxy post-processor is enabled but certificate and key are stored in two files. This combination usually does not work.")
+	}
+
+	if config.HaProxy.HAProxySocket != "" && config.Files.KeyEncryption.Enabled() {
+		log.Warn("HaProxy post-processor is enabled but the key is stored encrypted. HaProxy cannot load the written file on startup.")
+	}
+
+	if config.Files.SkipPEM && (config.HaProxy.HAProxySocket != "" || config.Nginx.ReloadNginx) {
+		log.Warn("PEM files are skipped but the HaProxy or Nginx post-processor is enabled. Both load their certificates from PEM files.")
+	}
 
-		// Request certificate
-		certs, key, err := acme.RequestCertificate(config.Certificate)
+	if config.Nginx.ReloadNginx && config.Files.SingleFile {
+		log.Warn("Nginx post-processor is enabled but certificate and key are stored in one combined file. This combination usually does not work.")
+	}
+
+	if config.Files.PKCS12File != "" && !config.Files.PKCS12Password.Configured() && !config.Files.PKCS12AllowEmptyPassword {
+		err := fmt.Errorf("PKCS#12 file %s needs a password (set pkcs12allowemptypassword to write it unprotected)", config.Files.PKCS12File)
+		log.Errorf("Invalid files configuration for %s: %s", config.Name, err.Error())
+		return nil, nil, err
+	}
+
+	if config.Files.JKSFile != "" && !config.Files.JKSStorePassword.Configured() && !config.Files.JKSAllowEmptyPassword {
+		err := fmt.Errorf("Java keystore %s needs a store password (set jksallowemptypassword to write it unprotected)", config.Files.JKSFile)
+		log.Errorf("Invalid files configuration for %s: %s", config.Name, err.Error())
+		return nil, nil, err
+	}
+
+	r := &runner{config: config}
+	if config.State.Directory != "" {
+		r.state = state.NewStore(config.State.Directory, config.Name)
+	}
+	schedule, err := newSchedule(config.Timing)
+	if err == nil {
+		r.window, err = parseWindow(config.Timing.DeployWindow)
+	}
+	if err != nil {
+		log.Errorf("Invalid timing configuration for %s: %s", config.Name, err.Error())
+		return nil, nil, err
+	}
+	if r.window != nil && schedule == nil {
+		log.Warnf("Deployment window is set for %s, which runs only once: the run waits up to a day for the window to open. Schedule the run within the window instead.", config.Name)
+	}
+	if r.elector, err = cluster.New(config.Cluster, maxInterval(schedule, config.Timing)); err != nil {
+		log.Errorf("Invalid cluster configuration for %s: %s", config.Name, err.Error())
+		return nil, nil, err
+	}
+	return r, schedule, nil
+}
+
+// runWithRetries runs the configuration and repeats runs with retryable failures with increasing delay
+// After failed runs, the next run backs off as recorded in the state: scheduled runs wait for it, single runs are skipped.
+func (r *runner) runWithRetries(ctx context.Context) *Result {
+	if nextRetry := r.nextRetry(); time.Now().Before(nextRetry) {
+		if !scheduled(r.config) {
+			log.Infof("Skipping run of %s, backing off after failed runs until %s", r.config.Name, nextRetry.Format(time.RFC3339))
+			return &Result{Name: r.config.Name, Skipped: true}
+		}
+		if !sleepUntil(ctx, nextRetry, "Run of "+r.config.Name+" backs off after failed runs until") {
+			return &Result{Name: r.config.Name, Skipped: true}
+		}
+	}
+
+	result := r.run(ctx)
+	for attempt := 0; result.Retryable() && attempt < maxRetries; attempt++ {
+		delay := retryDelay << uint(attempt)
+		log.Warnf("Run of %s failed, retrying in %s", result.Name, delay)
+		// a restarted process continues the back off instead of retrying at once
+		r.recordState(func(s *state.State) { s.NextRetry = time.Now().Add(delay) })
+		if !sleepUntil(ctx, time.Now().Add(delay), "Retry of "+r.config.Name) {
+			break
+		}
+		result = r.run(ctx)
+	}
+	r.recordResult(result)
+	if result.Failed() {
+		log.Error(result.String())
+	}
+	return result
+}
+
+func (r *runner) run(ctx context.Context) *Result {
+	config := r.config
+	result := &Result{Name: config.Name}
+	log.Infof("Starting Run for %s", config.Name)
+
+	store, err := storage.New(config)
+	if err != nil {
+		log.Errorf("Initializing storage failed with error %s", err.Error())
+		result.fail(PhaseStorage, false, err)
+		return result
+	}
+	unlock, err := store.Lock()
+	if err != nil {
+		log.Warnf("Locking storage failed with error %s", err.Error())
+		result.fail(PhaseStorage, true, err)
+		return result
+	}
+	if config.Files.CertFile != "" {
+		// other certbutler processes (e.g. a manual run or a container on a shared volume) may use the same files
+		unlockFile, err := common.LockFile(ctx, config.Files.CertFile+".lock", config.Lock)
+		if err == common.ErrLocked {
+			unlock()
+			log.Infof("Files of %s are locked by another process, skipping run", config.Name)
+			result.Skipped = true
+			return result
+		}
 		if err != nil {
-			log.Warnf("Requesting certificate for %s failed with error %s", common.FlattenStringSlice(config.Certificate.DNSNames), err.Error())
-		} else {
-			// Write Certificate to file
-			err = common.WriteCertToFile(certs, key, config.Files.CertFile, config.Files.KeyFile, config.Files.SingleFile)
-			if err != nil {
-				log.Fatalf("Writing ceritifcate to disk failed with error %s", err.Error())
+			unlock()
+			log.Warnf("Locking files of %s failed with error %s", config.Name, err.Error())
+			result.fail(PhaseStorage, true, err)
+			return result
+		}
+		unlockStore := unlock
+		unlock = func() {
+			unlockFile()
+			unlockStore()
+		}
+	}
+	var unlockOnce sync.Once
+	release := func() { unlockOnce.Do(unlock) }
+	defer release()
+
+	if !r.pendingRestored {
+		// updates an earlier process stored but could not deploy
+		r.pendingRestored = true
+		if r.pending == nil && r.deployPending() {
+			if _, stored, err := loadStored(store, config); err == nil {
+				r.pending = &stored
+			} else {
+				log.Warnf("Loading undeployed updates of %s failed with error %s", config.Name, err.Error())
 			}
-			log.Info("Certificate renewed and stored to file successfully")
+		}
+	}
+
+	// continue with updates which could not be deployed in the last run
+	updateResultData := common.UpdateResultData{}
+	if r.pending != nil {
+		log.Info("Deploying updates staged in the last run")
+		updateResultData = *r.pending
+	}
 
-			// Stage Certificate for updates
-			updateResultData.Certificates = certs
-			updateResultData.Key = key
+	if r.elector != nil {
+		// in cluster mode, only the leader talks to the CA
+		leader, err := r.elector.Acquire(ctx)
+		if err != nil {
+			// e.g. a corrupt or inaccessible lease => no node would renew the certificate, this has to be fixed
+			log.Errorf("Leader election for %s failed with error %s", config.Name, err.Error())
+			result.fail(PhaseCluster, false, err)
+			return result
+		}
+		if !leader {
+			r.follow(ctx, store, result, release)
+			return result
+		}
+	}
+
+	// check tasks for this run
+	needCert := !config.OCSP.Only && config.Timing.RenewalDueCert > 0 && acme.CheckCertRenew(store, config.Timing.RenewalDueCert) // has the certificate to be renewed?
+	if !needCert && config.CRL.Enabled {
+		// has the certificate been revoked?
+		err := ocsp.CheckCRL(store, config.OCSP, config.CRL)
+		if statusErr, ok := err.(*ocsp.StatusError); ok {
+			needCert = r.reportRevocation(store, "CRL", statusErr)
+			if !needCert {
+				result.fail(PhaseRevocation, false, err)
+			}
+		} else if err != nil {
+			log.Warnf("Checking CRL for %s failed with error %s", config.Files.CertFile, err.Error())
+			result.fail(PhaseRevocation, true, err)
+		}
+		if _, ok := err.(*ocsp.StatusError); ok || err == nil {
+			r.recordState(func(s *state.State) { s.LastCRLCheck = time.Now() })
 		}
+	}
+	needOCSP := config.Timing.RenewalDueOCSP > 0 && (needCert || ocsp.CheckOCSPRenew(store, config.OCSP, config.Timing.RenewalDueOCSP)) // has ocsp to be renewed?
+
+	certRenewed := false
+	if needCert {
+		log.Info("Certificate needs renewal")
+		certRenewed = r.renewCertificate(ctx, store, &updateResultData, result)
 	} else {
-		if config.Timing.RenewalDueCert > 0 {
+		if config.Timing.RenewalDueCert > 0 && !config.OCSP.Only {
 			log.Info("Certificate still valid, not renewing")
 		}
 	}
 
 	if needOCSP {
 		log.Info("OCSP response needs renewal")
-		ocspResponse, err := ocsp.GetOCSPResponse(config.Files.CertFile)
-		if err != nil {
-			log.Warnf("Requesting new OCSP response for %s failed with error %s", common.FlattenStringSlice(config.Certificate.DNSNames), err.Error())
-		} else {
-
-			// Store OCSP response in file
-			err = ioutil.WriteFile(config.Files.CertFile+".ocsp", ocspResponse, os.FileMode(int(0600)))
-			if err != nil {
-				log.Fatalf("Writing OCSP response to disk failed with error %s", err.Error())
+		ocspResponse, err := ocsp.GetOCSPResponse(store, config.OCSP)
+		if statusErr, ok := err.(*ocsp.StatusError); ok && !certRenewed && r.reportRevocation(store, "OCSP responder", statusErr) {
+			// the current certificate is revoked => replace it immediately, independent of its expiry
+			if certRenewed = r.renewCertificate(ctx, store, &updateResultData, result); certRenewed {
+				ocspResponse, err = ocsp.GetOCSPResponse(store, config.OCSP)
 			}
+		}
+		if err == ocsp.ErrNoResponder {
+			// e.g. CAs which dropped OCSP => nothing to staple
+			log.Infof("Certificate of %s contains no OCSP responder URL, skipping OCSP", config.Name)
+		} else if err != nil {
+			log.Warnf("Requesting new OCSP response for %s failed with error %s - keeping the previous response", config.Name, err.Error())
+			_, revoked := err.(*ocsp.StatusError)
+			result.fail(PhaseOCSP, !revoked, err)
+		} else if err = store.PutOCSP(ocspResponse); err != nil {
+			log.Warnf("Storing OCSP response failed with error %s", err.Error())
+			result.fail(PhaseOCSP, true, err)
+		} else {
 			log.Info("OCSP response renewed successfully")
+			r.updateUnknown(func(u *state.UnknownStatus) { *u = state.UnknownStatus{} })
+			r.recordState(func(s *state.State) { s.LastOCSPFetch = time.Now() })
 
 			// Stage ocsp response for updates
 			updateResultData.OCSPResponse = ocspResponse
@@ -106,28 +430,277 @@ func process(config common.Config) {
 		}
 	}
 
-	if needCert || needOCSP {
-		if config.HaProxy.HAProxySocket != "" {
-			err := postprocessing.ProcessHaProxy(config.HaProxy, config.Files, updateResultData)
-			if err != nil {
-				log.Fatalf("Error updating haproxy: %s", err.Error())
-			}
+	if needCert || needOCSP || r.pending != nil {
+		fingerprint := ""
+		if r.elector != nil {
+			// remember what was deployed, so this node does not deploy it again when it becomes a follower
+			fingerprint, _, _ = loadStored(store, config)
 		}
+		if r.deploy(ctx, updateResultData, result, release) && fingerprint != "" {
+			r.setDeployedFingerprint(fingerprint)
+		}
+	} else {
+		log.Info("No changes, nothing to process")
+	}
 
-		if config.Nginx.ReloadNginx {
-			err := postprocessing.ProcessNginx()
-			if err != nil {
-				log.Fatalf("Error updating nginx: %s", err.Error())
-			}
+	return result
+}
+
+// deploy runs the post-processors within the deployment window and keeps the updates for the next run if this fails
+// The storage is not needed for the deployment, so release is called to not block it while waiting for the window.
+func (r *runner) deploy(ctx context.Context, updateResultData common.UpdateResultData, result *Result, release func()) bool {
+	config := r.config
+
+	release()
+	if r.window != nil && !sleepUntil(ctx, r.window.next(time.Now()), "Deployment of "+config.Name+" waits for the deployment window") {
+		log.Warnf("Deployment of %s cancelled", config.Name)
+		r.setPending(&updateResultData)
+		result.fail(PhaseDeploy, true, ctx.Err())
+		return false
+	}
+
+	deployFailed := false
+	deploy := func(name string, err error) {
+		if err != nil {
+			log.Warnf("Error updating %s: %s", name, err.Error())
+			result.fail(PhaseDeploy, true, fmt.Errorf("%s: %v", name, err))
+			deployFailed = true
 		}
+	}
+
+	if config.HaProxy.HAProxySocket != "" {
+		deploy("haproxy", postprocessing.ProcessHaProxy(config.HaProxy, config.Files, updateResultData))
+	}
+
+	if config.Nginx.ReloadNginx {
+		deploy("nginx", postprocessing.ProcessNginx())
+	}
 
-		if config.DeployHook.Executable != "" {
-			err := postprocessing.ProcessDeployHook(config.DeployHook)
-			if err != nil {
-				log.Fatalf("Error updating nginx: %s", err.Error())
+	if config.DeployHook.Executable != "" {
+		deploy("deploy hook", postprocessing.ProcessDeployHook(config.DeployHook))
+	}
+
+	// keep the staged updates until they are deployed
+	if deployFailed {
+		r.setPending(&updateResultData)
+	} else {
+		r.setPending(nil)
+	}
+	return !deployFailed
+}
+
+// recordState updates the persistent state of the configuration, if enabled
+func (r *runner) recordState(update func(*state.State)) {
+	if r.state == nil {
+		return
+	}
+	if err := r.state.Update(update); err != nil {
+		log.Warnf("Updating state of %s failed with error %s", r.config.Name, err.Error())
+	}
+}
+
+// recordResult stores the outcome of a run including its retries in the persistent state; skipped runs are neither successes nor failures
+// Every failed run doubles the time until the next run may start, up to maxBackoff.
+func (r *runner) recordResult(result *Result) {
+	if result.Skipped && !result.Failed() {
+		return
+	}
+	r.recordState(func(s *state.State) {
+		s.LastRun = time.Now()
+		if result.Failed() {
+			s.LastError = result.String()
+			s.ConsecutiveFailures++
+			backoff := maxBackoff
+			if shift := maxRetries + s.ConsecutiveFailures - 1; shift < 20 && retryDelay<<uint(shift) < maxBackoff {
+				backoff = retryDelay << uint(shift)
 			}
+			s.NextRetry = s.LastRun.Add(backoff)
+		} else {
+			s.LastSuccess = s.LastRun
+			s.LastError = ""
+			s.ConsecutiveFailures = 0
+			s.NextRetry = time.Time{}
 		}
-	} else {
-		log.Info("No changes, nothing to process")
+	})
+}
+
+// nextRetry returns the time before which runs back off after failures; zero without state
+func (r *runner) nextRetry() time.Time {
+	if r.state == nil {
+		return time.Time{}
+	}
+	s, err := r.state.Load()
+	if err != nil {
+		log.Warnf("Loading state of %s failed with error %s", r.config.Name, err.Error())
+		return time.Time{}
+	}
+	return s.NextRetry
+}
+
+// deployPending returns whether the state records updates which were stored but not deployed
+func (r *runner) deployPending() bool {
+	if r.state == nil {
+		return false
+	}
+	s, err := r.state.Load()
+	if err != nil {
+		log.Warnf("Loading state of %s failed with error %s", r.config.Name, err.Error())
+		return false
+	}
+	return s.DeployPending
+}
+
+// setPending keeps updates for the next run; the state records them so that they are also deployed after a restart
+func (r *runner) setPending(updateResultData *common.UpdateResultData) {
+	r.pending = updateResultData
+	r.recordState(func(s *state.State) { s.DeployPending = updateResultData != nil })
+}
+
+// reportRevocation logs a revoked or unknown certificate as event and returns whether the certificate should be reissued
+// Revoked certificates are reissued immediately. Responders may not know a freshly issued certificate yet, so an unknown
+// certificate is only reissued once it is older than unknownGracePeriod and has been reported unknownReports times in a row,
+// and at most once per certificate.
+func (r *runner) reportRevocation(store storage.Storage, source string, statusErr *ocsp.StatusError) bool {
+	config := r.config
+	entry := log.WithFields(log.Fields{
+		"event":    "certificate_" + statusErr.StatusName(),
+		"certfile": config.Files.CertFile,
+		"names":    common.FlattenStringSlice(config.Certificate.DNSNames),
+		"status":   statusErr.StatusName(),
+	})
+	if config.OCSP.Only {
+		// certificate is managed elsewhere => can only be reported
+		entry.Errorf("%s reports the certificate %s as %s - it has to be replaced manually", source, config.Files.CertFile, statusErr.StatusName())
+		return false
+	}
+	if statusErr.Revoked() {
+		entry.Errorf("%s reports the certificate %s as %s - reissuing immediately", source, config.Files.CertFile, statusErr.StatusName())
+		return true
+	}
+
+	bundle, err := store.GetCertificate()
+	if err != nil || len(bundle.Certificates) == 0 {
+		entry.Warnf("%s reports the certificate %s as %s - not reissuing, the certificate could not be loaded", source, config.Files.CertFile, statusErr.StatusName())
+		return false
+	}
+	leaf := bundle.Certificates[0]
+	serial := leaf.SerialNumber.Text(16)
+	now := time.Now()
+	unknown := r.updateUnknown(func(u *state.UnknownStatus) {
+		if u.Serial != serial {
+			*u = state.UnknownStatus{Serial: serial, Since: now}
+		}
+		u.Count++
+	})
+	if unknown.Reissued || unknown.Count < unknownReports || now.Sub(leaf.NotBefore) < unknownGracePeriod {
+		entry.Warnf("%s reports the certificate %s as %s (%d times in a row) - not reissuing yet, keeping the previous OCSP response", source, config.Files.CertFile, statusErr.StatusName(), unknown.Count)
+		return false
+	}
+	r.updateUnknown(func(u *state.UnknownStatus) { u.Reissued = true })
+	entry.Errorf("%s reports the certificate %s as %s since %s - reissuing immediately", source, config.Files.CertFile, statusErr.StatusName(), unknown.Since.Format(time.RFC3339))
+	return true
+}
+
+// updateUnknown applies update to the "unknown" reports of the revocation sources and returns the result
+func (r *runner) updateUnknown(update func(*state.UnknownStatus)) state.UnknownStatus {
+	if r.state == nil {
+		update(&r.unknown)
+		return r.unknown
+	}
+	var unknown state.UnknownStatus
+	r.recordState(func(s *state.State) {
+		update(&s.Unknown)
+		unknown = s.Unknown
+	})
+	return unknown
+}
+
+// lockAccount locks the acme account file of the configuration
+// Configurations of this process sharing the account wait for each other, the lock file only guards against other processes.
+func lockAccount(ctx context.Context, config common.Config) (func(), error) {
+	filename := config.Certificate.AcmeAccountFile
+	if abs, err := filepath.Abs(filename); err == nil {
+		filename = abs
+	}
+	accountLocksMux.Lock()
+	lock, ok := accountLocks[filename]
+	if !ok {
+		lock = &sync.Mutex{}
+		accountLocks[filename] = lock
+	}
+	accountLocksMux.Unlock()
+
+	lock.Lock()
+	unlockFile, err := common.LockFile(ctx, filename+".lock", config.Lock)
+	if err != nil {
+		lock.Unlock()
+		return nil, err
+	}
+	return func() {
+		unlockFile()
+		lock.Unlock()
+	}, nil
+}
+
+// renewCertificate requests, verifies and stores a new certificate and stages it for the post-processors
+func (r *runner) renewCertificate(ctx context.Context, store storage.Storage, updateResultData *common.UpdateResultData, result *Result) bool {
+	config := r.config
+
+	// Request certificate; the acme account is locked so that other processes do not register or use it at the same time
+	unlockAccount := func() {}
+	if config.Certificate.AcmeAccountFile != "" {
+		var err error
+		unlockAccount, err = lockAccount(ctx, config)
+		if err == common.ErrLocked {
+			log.Infof("Acme account of %s is locked by another process, skipping certificate request", config.Name)
+			result.Skipped = true
+			return false
+		}
+		if err != nil {
+			log.Warnf("Locking acme account of %s failed with error %s", config.Name, err.Error())
+			result.fail(PhaseCertificate, true, err)
+			return false
+		}
+	}
+	certs, key, orderURL, err := acme.RequestCertificate(ctx, config.Certificate, store)
+	unlockAccount()
+	if orderURL != "" {
+		r.recordState(func(s *state.State) { s.LastOrderURL = orderURL })
+	}
+	if err != nil {
+		log.Warnf("Requesting certificate for %s failed with error %s", common.FlattenStringSlice(config.Certificate.DNSNames), err.Error())
+		result.fail(PhaseCertificate, acme.Retryable(err), err)
+		return false
+	}
+	if err = acme.VerifyCertificate(certs, key, config.Certificate); err != nil {
+		log.Warnf("Verifying new certificate for %s failed with error %s - keeping the old certificate", common.FlattenStringSlice(config.Certificate.DNSNames), err.Error())
+		result.fail(PhaseCertificate, false, err)
+		return false
 	}
+	if result.SCTs, err = ct.Check(certs, config.CT); err != nil {
+		log.Warnf("Verifying SCTs of new certificate for %s failed with error %s - keeping the old certificate", common.FlattenStringSlice(config.Certificate.DNSNames), err.Error())
+		result.fail(PhaseCertificate, false, err)
+		return false
+	}
+
+	// Write Certificate to storage
+	err = store.PutCertificate(certs, key)
+	if err != nil {
+		log.Warnf("Storing ceritifcate failed with error %s", err.Error())
+		result.fail(PhaseCertificate, true, err)
+		return false
+	}
+	log.Info("Certificate renewed and stored to file successfully")
+	if leaf, err := x509.ParseCertificate(certs[0]); err == nil {
+		r.recordState(func(s *state.State) {
+			issued := state.IssuedCertificate{Serial: leaf.SerialNumber.Text(16), Issued: time.Now(), NotAfter: leaf.NotAfter, OrderURL: orderURL}
+			s.Certificates = append([]state.IssuedCertificate{issued}, s.Certificates...)
+		})
+	}
+
+	// Stage Certificate for updates; a staged OCSP response belongs to the old certificate
+	updateResultData.Certificates = certs
+	updateResultData.Key = key
+	updateResultData.OCSPResponse = nil
+	return true
 }
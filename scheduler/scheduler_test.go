@@ -0,0 +1,69 @@
+package scheduler
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"felix-hartmond.de/projects/certbutler/common"
+)
+
+func TestLockAccountWithinProcess(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certbutler-account")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	config := common.Config{Lock: common.LockConfiguration{Mode: "skip"}}
+	config.Certificate.AcmeAccountFile = filepath.Join(dir, "account.key")
+
+	// configurations of one process sharing an account wait for each other instead of being skipped
+	var wg sync.WaitGroup
+	errs := make(chan error, 4)
+	for i := 0; i < cap(errs); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			unlock, err := lockAccount(context.Background(), config)
+			if err != nil {
+				errs <- err
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+			unlock()
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("lockAccount failed: %v", err)
+	}
+}
+
+func TestNewRunnerRejectsUnprotectedKeyFiles(t *testing.T) {
+	tests := []struct {
+		name    string
+		files   common.FilesConfiguration
+		wantErr bool
+	}{
+		{"pkcs12 with password", common.FilesConfiguration{PKCS12File: "example.com.p12", PKCS12Password: common.Secret{File: "p12.pass"}}, false},
+		{"pkcs12 without password", common.FilesConfiguration{PKCS12File: "example.com.p12"}, true},
+		{"pkcs12 with allowed empty password", common.FilesConfiguration{PKCS12File: "example.com.p12", PKCS12AllowEmptyPassword: true}, false},
+		{"jks with password", common.FilesConfiguration{JKSFile: "example.com.jks", JKSStorePassword: common.Secret{File: "jks.pass"}}, false},
+		{"jks without password", common.FilesConfiguration{JKSFile: "example.com.jks"}, true},
+		{"jks with allowed empty password", common.FilesConfiguration{JKSFile: "example.com.jks", JKSAllowEmptyPassword: true}, false},
+	}
+	for _, test := range tests {
+		_, _, err := newRunner(common.Config{Name: test.name, Files: test.files})
+		if test.wantErr && err == nil {
+			t.Errorf("%s: newRunner accepted the configuration", test.name)
+		} else if !test.wantErr && err != nil {
+			t.Errorf("%s: newRunner failed: %v", test.name, err)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package scheduler
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	log "github.com/sirupsen/logrus"
+
+	"felix-hartmond.de/projects/certbutler/common"
+)
+
+// window is a daily time range in local time; end before start wraps around midnight
+type window struct {
+	start, end time.Duration // offsets from midnight
+}
+
+// newSchedule creates the schedule of a configuration from its cron expression or run interval; nil means a single run
+func newSchedule(timing common.TimingConfiguration) (cron.Schedule, error) {
+	if timing.Schedule != "" {
+		schedule, err := cron.ParseStandard(timing.Schedule)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid schedule %s: %v", timing.Schedule, err)
+		}
+		return schedule, nil
+	}
+	if timing.RunIntervalMinutes > 0 {
+		return cron.Every(time.Duration(timing.RunIntervalMinutes) * time.Minute), nil
+	}
+	return nil, nil
+}
+
+// maxInterval returns the longest time between two of the next scheduled runs including jitter; 0 for a single run
+func maxInterval(schedule cron.Schedule, timing common.TimingConfiguration) time.Duration {
+	if schedule == nil {
+		return 0
+	}
+	longest := time.Duration(0)
+	next := schedule.Next(time.Now())
+	for i := 0; i < 10; i++ {
+		following := schedule.Next(next)
+		if gap := following.Sub(next); gap > longest {
+			longest = gap
+		}
+		next = following
+	}
+	return longest + time.Duration(timing.JitterSeconds)*time.Second
+}
+
+// parseWindow parses a time range like "02:00-05:00"; an empty string allows all times
+func parseWindow(value string) (*window, error) {
+	if value == "" {
+		return nil, nil
+	}
+	parts := strings.Split(value, "-")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("Invalid deployment window %s, expected format hh:mm-hh:mm", value)
+	}
+	offsets := []time.Duration{}
+	for _, part := range parts {
+		// time.Parse rejects hours above 23 and minutes above 59
+		t, err := time.Parse("15:04", strings.TrimSpace(part))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid deployment window %s, expected format hh:mm-hh:mm with times from 00:00 to 23:59", value)
+		}
+		offsets = append(offsets, time.Duration(t.Hour())*time.Hour+time.Duration(t.Minute())*time.Minute)
+	}
+	if offsets[0] == offsets[1] {
+		return nil, fmt.Errorf("Deployment window %s never opens as start and end are equal; leave it unset to deploy at any time", value)
+	}
+	return &window{start: offsets[0], end: offsets[1]}, nil
+}
+
+// next returns now if now is within the window, otherwise the next start of the window
+func (w *window) next(now time.Time) time.Time {
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	offset := now.Sub(midnight)
+
+	if w.start <= w.end && offset >= w.start && offset < w.end {
+		return now
+	}
+	if w.start > w.end && (offset >= w.start || offset < w.end) {
+		return now
+	}
+
+	start := midnight.Add(w.start)
+	if !start.After(now) {
+		start = start.AddDate(0, 0, 1)
+	}
+	return start
+}
+
+// jitter returns a random delay up to the configured jitter
+// crypto/rand is used, as the default math/rand source yields the same delays on every host.
+func jitter(timing common.TimingConfiguration) time.Duration {
+	if timing.JitterSeconds <= 0 {
+		return 0
+	}
+	delay, err := rand.Int(rand.Reader, big.NewInt(int64(timing.JitterSeconds)*int64(time.Second)))
+	if err != nil {
+		return 0
+	}
+	return time.Duration(delay.Int64())
+}
+
+// sleepUntil waits until the given time and returns false if ctx is cancelled before
+func sleepUntil(ctx context.Context, t time.Time, reason string) bool {
+	delay := time.Until(t)
+	if delay <= 0 {
+		return ctx.Err() == nil
+	}
+
+	log.Infof("%s at %s", reason, t.Format(time.RFC3339))
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,121 @@
+package state
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"felix-hartmond.de/projects/certbutler/common"
+)
+
+const maxHistory = 10
+
+var unsafeChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// State holds what certbutler knows about the past runs of one configuration
+type State struct {
+	LastRun             time.Time
+	LastSuccess         time.Time
+	LastError           string
+	ConsecutiveFailures int       // failed runs in a row; retries within a run are not counted
+	NextRetry           time.Time // runs before this time wait or are skipped to back off after failures
+
+	DeployPending bool // the stored certificate or OCSP response has not been deployed yet
+
+	LastOrderURL  string
+	LastOCSPFetch time.Time
+	LastCRLCheck  time.Time
+
+	Certificates []IssuedCertificate // newest first
+
+	DeployedFingerprint string // hash of the stored certificate and OCSP response last deployed in cluster mode
+
+	Unknown UnknownStatus // "unknown" reports of the revocation sources for the current certificate
+}
+
+// UnknownStatus counts consecutive "unknown" reports for one certificate
+type UnknownStatus struct {
+	Serial   string
+	Count    int
+	Since    time.Time // time of the first report
+	Reissued bool      // a reissue has already been triggered for this certificate
+}
+
+// IssuedCertificate describes a certificate issued by certbutler
+type IssuedCertificate struct {
+	Serial   string
+	Issued   time.Time
+	NotAfter time.Time
+	OrderURL string
+}
+
+// Store persists the state of one configuration as json file in the state directory
+type Store struct {
+	filename string
+	mux      sync.Mutex
+}
+
+// NewStore creates the store for the configuration with the given name
+func NewStore(directory, name string) *Store {
+	return &Store{filename: Filename(directory, name)}
+}
+
+// Filename returns the file holding the state of the configuration with the given name
+// Characters which are unsafe in file names are replaced, so different names may share a file.
+func Filename(directory, name string) string {
+	return filepath.Join(directory, unsafeChars.ReplaceAllString(name, "_")+".json")
+}
+
+// Load reads the state; a missing file results in an empty state
+func (s *Store) Load() (*State, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.load()
+}
+
+// Update reads the state, applies update and writes it back
+func (s *Store) Update(update func(*State)) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	state, err := s.load()
+	if err != nil {
+		return err
+	}
+	update(state)
+	if len(state.Certificates) > maxHistory {
+		state.Certificates = state.Certificates[:maxHistory]
+	}
+
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(s.filename), 0755); err != nil {
+		return err
+	}
+	return common.WriteFileAtomic(s.filename, data, common.FilePermissions{})
+}
+
+func (s *Store) load() (*State, error) {
+	state := &State{}
+	data, err := ioutil.ReadFile(s.filename)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(data, state); err != nil {
+		// a damaged file must not block all further updates => start over
+		log.Warnf("State file %s is corrupt (%s), starting with an empty state", s.filename, err.Error())
+		return &State{}, nil
+	}
+	return state, nil
+}
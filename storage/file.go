@@ -0,0 +1,162 @@
+package storage
+
+import (
+	"crypto/ecdsa"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+
+	"felix-hartmond.de/projects/certbutler/common"
+)
+
+var (
+	fileLocks    = map[string]*sync.Mutex{}
+	fileLocksMux sync.Mutex
+)
+
+// FileStorage stores all items in local files as configured in the files section
+type FileStorage struct {
+	files       common.FilesConfiguration
+	accountFile string
+}
+
+// NewFileStorage creates a storage backend for the local file layout
+func NewFileStorage(files common.FilesConfiguration, accountFile string) *FileStorage {
+	return &FileStorage{files: files, accountFile: accountFile}
+}
+
+// GetCertificate loads all certificates from the certificate file, or from the other formats if PEM files are skipped
+func (s *FileStorage) GetCertificate() (*common.Bundle, error) {
+	if s.files.SkipPEM {
+		return s.loadAdditionalFormats()
+	}
+	bundle, err := common.LoadBundle(s.files.CertFile)
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	return bundle, err
+}
+
+// GetKey loads the key from the key file or the certificate file if both are stored in one file
+func (s *FileStorage) GetKey() (*ecdsa.PrivateKey, error) {
+	if s.files.SkipPEM {
+		bundle, err := s.loadAdditionalFormats()
+		if err != nil {
+			return nil, err
+		}
+		if len(bundle.Keys) == 0 {
+			// DER files contain no key
+			return nil, ErrNotFound
+		}
+		return bundle.ECKey()
+	}
+	keyFile := s.files.KeyFile
+	if s.files.SingleFile {
+		keyFile = s.files.CertFile
+	}
+	return s.loadKey(keyFile)
+}
+
+// PutCertificate writes certificate and key to all configured files
+func (s *FileStorage) PutCertificate(certs [][]byte, key *ecdsa.PrivateKey) error {
+	return common.WriteCertToFile(certs, key, s.files)
+}
+
+// GetOCSP loads the OCSP response from the OCSP file
+func (s *FileStorage) GetOCSP() ([]byte, error) {
+	ocspResponse, err := ioutil.ReadFile(s.ocspFile())
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	return ocspResponse, err
+}
+
+// PutOCSP writes the OCSP response to the OCSP file
+func (s *FileStorage) PutOCSP(ocspResponse []byte) error {
+	return common.WriteFileAtomic(s.ocspFile(), ocspResponse, s.files.OCSPPermissions)
+}
+
+// GetAccountKey loads the ACME account key. If key encryption is enabled, an unencrypted key file is encrypted.
+func (s *FileStorage) GetAccountKey() (*ecdsa.PrivateKey, error) {
+	key, err := s.loadKey(s.accountFile)
+	if err != nil || !s.files.KeyEncryption.Enabled() {
+		return key, err
+	}
+
+	encrypted, err := common.KeyEncrypted(s.accountFile)
+	if err == nil && !encrypted {
+		// an archived copy would keep the plaintext key on disk
+		log.Infof("Encrypting account key %s", s.accountFile)
+		err = common.SaveToPEMFile(s.accountFile, key, nil, common.FileOptions{KeyEncryption: s.files.KeyEncryption, NoArchive: true})
+	}
+	if err != nil {
+		log.Warnf("Encrypting account key %s failed with error %s", s.accountFile, err.Error())
+	}
+	return key, nil
+}
+
+// PutAccountKey writes the ACME account key
+func (s *FileStorage) PutAccountKey(key *ecdsa.PrivateKey) error {
+	return common.SaveToPEMFile(s.accountFile, key, nil, common.FileOptions{KeyEncryption: s.files.KeyEncryption})
+}
+
+// List returns all existing files of this configuration
+func (s *FileStorage) List() ([]string, error) {
+	candidates := []string{s.files.CertFile, s.ocspFile(), s.accountFile, s.files.LeafFile, s.files.ChainFile, s.files.FullchainFile,
+		s.files.DERLeafFile, s.files.DERChainFile, s.files.PKCS12File, s.files.JKSFile}
+	if !s.files.SingleFile {
+		candidates = append(candidates, s.files.KeyFile)
+	}
+
+	existing := []string{}
+	for _, filename := range candidates {
+		if filename == "" {
+			continue
+		}
+		if _, err := os.Stat(filename); err == nil {
+			existing = append(existing, filename)
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	return existing, nil
+}
+
+// Lock serializes access to the files of the certificate within this process
+func (s *FileStorage) Lock() (func(), error) {
+	fileLocksMux.Lock()
+	lock, ok := fileLocks[s.files.CertFile]
+	if !ok {
+		lock = &sync.Mutex{}
+		fileLocks[s.files.CertFile] = lock
+	}
+	fileLocksMux.Unlock()
+
+	lock.Lock()
+	return lock.Unlock, nil
+}
+
+func (s *FileStorage) loadKey(filename string) (*ecdsa.PrivateKey, error) {
+	key, err := common.LoadKey(filename, s.files.KeyEncryption)
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	return key, err
+}
+
+func (s *FileStorage) loadAdditionalFormats() (*common.Bundle, error) {
+	bundle, err := common.LoadAdditionalFormats(s.files)
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	return bundle, err
+}
+
+func (s *FileStorage) ocspFile() string {
+	if s.files.OCSPFile != "" {
+		return s.files.OCSPFile
+	}
+	return s.files.CertFile + ".ocsp"
+}
@@ -0,0 +1,375 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"felix-hartmond.de/projects/certbutler/common"
+)
+
+const (
+	s3DefaultRegion = "us-east-1"
+	s3Timeout       = 30 * time.Second
+	s3TimeFormat    = "20060102T150405Z"
+	s3DateFormat    = "20060102"
+
+	s3ObjectFullchain = "fullchain.pem"
+	s3ObjectChain     = "chain.pem"
+	s3ObjectLeaf      = "cert.pem"
+	s3ObjectKey       = "privkey.pem"
+	s3ObjectOCSP      = "ocsp.der"
+)
+
+var (
+	s3Locks    = map[string]*sync.Mutex{}
+	s3LocksMux sync.Mutex
+)
+
+// S3Storage stores all items as objects in an S3 compatible bucket (e.g. AWS S3 or MinIO)
+// The objects are named like certbot's files below the configured prefix.
+type S3Storage struct {
+	config      common.S3Configuration
+	accountFile *FileStorage // used for the account key if no account key object is configured
+	endpoint    *url.URL
+	client      *http.Client
+}
+
+type s3ListResult struct {
+	Contents []struct {
+		Key string `xml:"Key"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// NewS3Storage creates a storage backend for an S3 compatible bucket
+func NewS3Storage(config common.S3Configuration, accountFile *FileStorage) (*S3Storage, error) {
+	if config.Endpoint == "" || config.Bucket == "" {
+		return nil, fmt.Errorf("S3 storage needs endpoint and bucket")
+	}
+	endpoint, err := url.Parse(strings.TrimRight(config.Endpoint, "/"))
+	if err != nil {
+		return nil, err
+	}
+	if endpoint.Scheme != "http" && endpoint.Scheme != "https" {
+		return nil, fmt.Errorf("S3 endpoint %s has to be a http(s) url", config.Endpoint)
+	}
+	if config.Region == "" {
+		config.Region = s3DefaultRegion
+	}
+
+	return &S3Storage{
+		config:      config,
+		accountFile: accountFile,
+		endpoint:    endpoint,
+		client:      &http.Client{Timeout: s3Timeout},
+	}, nil
+}
+
+// GetCertificate reads the full chain object
+func (s *S3Storage) GetCertificate() (*common.Bundle, error) {
+	fullchain, err := s.getObject(s.config.Prefix + s3ObjectFullchain)
+	if err != nil {
+		return nil, err
+	}
+	return common.ParseBundle(fullchain)
+}
+
+// GetKey reads the private key object
+func (s *S3Storage) GetKey() (*ecdsa.PrivateKey, error) {
+	keyPem, err := s.getObject(s.config.Prefix + s3ObjectKey)
+	if err != nil {
+		return nil, err
+	}
+	return common.ParseKey(keyPem, common.KeyEncryptionConfiguration{})
+}
+
+// PutCertificate uploads full chain, chain, leaf and key. A stored OCSP response belongs to the old certificate and is removed.
+func (s *S3Storage) PutCertificate(certs [][]byte, key *ecdsa.PrivateKey) error {
+	objects := []struct {
+		name  string
+		key   *ecdsa.PrivateKey
+		certs [][]byte
+	}{
+		{s3ObjectKey, key, nil},
+		{s3ObjectLeaf, nil, certs[:1]},
+		{s3ObjectChain, nil, certs[1:]},
+		{s3ObjectFullchain, nil, certs}, // last as it is read for renewal checks
+	}
+	for _, object := range objects {
+		data, err := common.EncodePem(object.key, object.certs)
+		if err != nil {
+			return err
+		}
+		if err = s.putObject(s.config.Prefix+object.name, data); err != nil {
+			return err
+		}
+	}
+	return s.deleteObject(s.config.Prefix + s3ObjectOCSP)
+}
+
+// GetOCSP reads the OCSP response object
+func (s *S3Storage) GetOCSP() ([]byte, error) {
+	return s.getObject(s.config.Prefix + s3ObjectOCSP)
+}
+
+// PutOCSP uploads the OCSP response
+func (s *S3Storage) PutOCSP(ocspResponse []byte) error {
+	return s.putObject(s.config.Prefix+s3ObjectOCSP, ocspResponse)
+}
+
+// GetAccountKey reads the ACME account key from the account key object or the local account file
+func (s *S3Storage) GetAccountKey() (*ecdsa.PrivateKey, error) {
+	if s.config.AccountKeyObject == "" {
+		return s.accountFile.GetAccountKey()
+	}
+	keyPem, err := s.getObject(s.config.AccountKeyObject)
+	if err != nil {
+		return nil, err
+	}
+	return common.ParseKey(keyPem, common.KeyEncryptionConfiguration{})
+}
+
+// PutAccountKey uploads the ACME account key to the account key object or writes the local account file
+func (s *S3Storage) PutAccountKey(key *ecdsa.PrivateKey) error {
+	if s.config.AccountKeyObject == "" {
+		return s.accountFile.PutAccountKey(key)
+	}
+	keyPem, err := common.EncodePem(key, nil)
+	if err != nil {
+		return err
+	}
+	return s.putObject(s.config.AccountKeyObject, keyPem)
+}
+
+// List returns all objects below the prefix
+func (s *S3Storage) List() ([]string, error) {
+	objects := []string{}
+	continuationToken := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {s.config.Prefix}}
+		if continuationToken != "" {
+			query.Set("continuation-token", continuationToken)
+		}
+		status, body, err := s.request(http.MethodGet, "", query, nil)
+		if err != nil {
+			return nil, err
+		}
+		if status != http.StatusOK {
+			return nil, fmt.Errorf("Listing bucket %s failed with status %d: %s", s.config.Bucket, status, strings.TrimSpace(string(body)))
+		}
+
+		var result s3ListResult
+		if err = xml.Unmarshal(body, &result); err != nil {
+			return nil, err
+		}
+		for _, content := range result.Contents {
+			objects = append(objects, content.Key)
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		continuationToken = result.NextContinuationToken
+	}
+	sort.Strings(objects)
+	return objects, nil
+}
+
+// Lock serializes access to the objects below the prefix within this process
+func (s *S3Storage) Lock() (func(), error) {
+	s3LocksMux.Lock()
+	id := s.endpoint.String() + "/" + s.config.Bucket + "/" + s.config.Prefix
+	lock, ok := s3Locks[id]
+	if !ok {
+		lock = &sync.Mutex{}
+		s3Locks[id] = lock
+	}
+	s3LocksMux.Unlock()
+
+	lock.Lock()
+	return lock.Unlock, nil
+}
+
+func (s *S3Storage) getObject(name string) ([]byte, error) {
+	status, body, err := s.request(http.MethodGet, name, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	switch status {
+	case http.StatusOK:
+		return body, nil
+	case http.StatusNotFound:
+		return nil, ErrNotFound
+	default:
+		return nil, fmt.Errorf("Downloading %s failed with status %d: %s", name, status, strings.TrimSpace(string(body)))
+	}
+}
+
+func (s *S3Storage) putObject(name string, data []byte) error {
+	status, body, err := s.request(http.MethodPut, name, nil, data)
+	if err != nil {
+		return err
+	}
+	if status != http.StatusOK {
+		return fmt.Errorf("Uploading %s failed with status %d: %s", name, status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+func (s *S3Storage) deleteObject(name string) error {
+	status, body, err := s.request(http.MethodDelete, name, nil, nil)
+	if err != nil {
+		return err
+	}
+	if status != http.StatusNoContent && status != http.StatusOK && status != http.StatusNotFound {
+		return fmt.Errorf("Deleting %s failed with status %d: %s", name, status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// request sends a SigV4 signed request for an object (or the bucket if name is empty) and returns status and body
+func (s *S3Storage) request(method, name string, query url.Values, payload []byte) (int, []byte, error) {
+	requestURL := *s.endpoint
+	objectPath := "/" + name
+	if s.config.PathStyle {
+		requestURL.Path = s.endpoint.Path + "/" + s.config.Bucket + objectPath
+	} else {
+		requestURL.Host = s.config.Bucket + "." + s.endpoint.Host
+		requestURL.Path = s.endpoint.Path + objectPath
+	}
+	requestURL.RawPath = s3EscapePath(requestURL.Path)
+	requestURL.RawQuery = s3CanonicalQuery(query)
+
+	request, err := http.NewRequest(method, requestURL.String(), bytes.NewReader(payload))
+	if err != nil {
+		return 0, nil, err
+	}
+	if method == http.MethodPut && s.config.ServerSideEncryption != "" {
+		request.Header.Set("X-Amz-Server-Side-Encryption", s.config.ServerSideEncryption)
+		if s.config.KMSKeyID != "" {
+			request.Header.Set("X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id", s.config.KMSKeyID)
+		}
+	}
+	if err = s.sign(request, payload, time.Now()); err != nil {
+		return 0, nil, err
+	}
+
+	response, err := s.client.Do(request)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	return response.StatusCode, body, err
+}
+
+// sign adds an AWS signature version 4 authorization header to the request
+func (s *S3Storage) sign(request *http.Request, payload []byte, now time.Time) error {
+	secretKey, err := s.config.SecretAccessKey.Read()
+	if err != nil {
+		return fmt.Errorf("Reading S3 secret access key failed: %v", err)
+	}
+
+	now = now.UTC()
+	payloadHash := sha256.Sum256(payload)
+	request.Header.Set("X-Amz-Date", now.Format(s3TimeFormat))
+	request.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+
+	// canonical headers: host and all x-amz-* headers, lower case and sorted
+	headers := map[string]string{"host": request.URL.Host}
+	for name, values := range request.Header {
+		lowerName := strings.ToLower(name)
+		if strings.HasPrefix(lowerName, "x-amz-") {
+			headers[lowerName] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	headerNames := []string{}
+	for name := range headers {
+		headerNames = append(headerNames, name)
+	}
+	sort.Strings(headerNames)
+	canonicalHeaders := ""
+	for _, name := range headerNames {
+		canonicalHeaders += name + ":" + headers[name] + "\n"
+	}
+	signedHeaders := strings.Join(headerNames, ";")
+
+	canonicalRequest := strings.Join([]string{
+		request.Method,
+		request.URL.EscapedPath(),
+		request.URL.RawQuery,
+		canonicalHeaders,
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+	canonicalRequestHash := sha256.Sum256([]byte(canonicalRequest))
+
+	scope := now.Format(s3DateFormat) + "/" + s.config.Region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + now.Format(s3TimeFormat) + "\n" + scope + "\n" + hex.EncodeToString(canonicalRequestHash[:])
+
+	signingKey := s3HMAC([]byte("AWS4"+secretKey), now.Format(s3DateFormat))
+	signingKey = s3HMAC(signingKey, s.config.Region)
+	signingKey = s3HMAC(signingKey, "s3")
+	signingKey = s3HMAC(signingKey, "aws4_request")
+	signature := hex.EncodeToString(s3HMAC(signingKey, stringToSign))
+
+	request.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", s.config.AccessKeyID, scope, signedHeaders, signature))
+	return nil
+}
+
+func s3HMAC(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3EscapePath encodes every path segment as required for SigV4 (everything except unreserved characters)
+func s3EscapePath(path string) string {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		segments[i] = s3Escape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+// s3CanonicalQuery encodes the query sorted by key as required for SigV4
+func s3CanonicalQuery(query url.Values) string {
+	keys := []string{}
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	parts := []string{}
+	for _, key := range keys {
+		for _, value := range query[key] {
+			parts = append(parts, s3Escape(key)+"="+s3Escape(value))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+func s3Escape(value string) string {
+	var escaped strings.Builder
+	for _, b := range []byte(value) {
+		if (b >= 'A' && b <= 'Z') || (b >= 'a' && b <= 'z') || (b >= '0' && b <= '9') || b == '-' || b == '_' || b == '.' || b == '~' {
+			escaped.WriteByte(b)
+		} else {
+			fmt.Fprintf(&escaped, "%%%02X", b)
+		}
+	}
+	return escaped.String()
+}
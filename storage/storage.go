@@ -0,0 +1,83 @@
+package storage
+
+import (
+	"crypto/ecdsa"
+	"errors"
+	"fmt"
+
+	"felix-hartmond.de/projects/certbutler/common"
+)
+
+// ErrNotFound is returned if the requested item does not exist in the storage
+var ErrNotFound = errors.New("Item not found in storage")
+
+// Storage stores the certificate, key, OCSP response and ACME account key of one configuration
+type Storage interface {
+	// GetCertificate returns the stored certificates
+	GetCertificate() (*common.Bundle, error)
+	// GetKey returns the private key of the stored certificate
+	GetKey() (*ecdsa.PrivateKey, error)
+	// PutCertificate stores a new certificate chain together with its private key
+	PutCertificate(certs [][]byte, key *ecdsa.PrivateKey) error
+
+	// GetOCSP returns the stored (DER encoded) OCSP response
+	GetOCSP() ([]byte, error)
+	// PutOCSP stores a new OCSP response
+	PutOCSP(ocspResponse []byte) error
+
+	// GetAccountKey returns the key of the ACME account
+	GetAccountKey() (*ecdsa.PrivateKey, error)
+	// PutAccountKey stores the key of a new ACME account
+	PutAccountKey(key *ecdsa.PrivateKey) error
+
+	// List returns the names of all items currently stored for this configuration
+	List() ([]string, error)
+	// Lock acquires exclusive access to the stored items of this configuration until the returned function is called
+	Lock() (func(), error)
+}
+
+// New creates the storage backend selected in the configuration
+func New(config common.Config) (Storage, error) {
+	fileStorage := NewFileStorage(config.Files, config.Certificate.AcmeAccountFile)
+
+	var backend Storage
+	var err error
+	switch config.Storage.Backend {
+	case "", "file":
+		return fileStorage, nil
+	case "vault":
+		backend, err = NewVaultStorage(config.Storage.Vault, fileStorage)
+	case "s3":
+		backend, err = NewS3Storage(config.Storage.S3, fileStorage)
+	default:
+		return nil, fmt.Errorf("Unknown storage backend %s", config.Storage.Backend)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if config.Storage.KeepLocalFiles {
+		return &mirrorStorage{Storage: backend, mirror: fileStorage}, nil
+	}
+	return backend, nil
+}
+
+// mirrorStorage reads from the backend and writes to both the backend and local files
+type mirrorStorage struct {
+	Storage
+	mirror *FileStorage
+}
+
+func (s *mirrorStorage) PutCertificate(certs [][]byte, key *ecdsa.PrivateKey) error {
+	if err := s.Storage.PutCertificate(certs, key); err != nil {
+		return err
+	}
+	return s.mirror.PutCertificate(certs, key)
+}
+
+func (s *mirrorStorage) PutOCSP(ocspResponse []byte) error {
+	if err := s.Storage.PutOCSP(ocspResponse); err != nil {
+		return err
+	}
+	return s.mirror.PutOCSP(ocspResponse)
+}
@@ -0,0 +1,167 @@
+package storage
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"felix-hartmond.de/projects/certbutler/common"
+)
+
+// newTestDir creates a temporary directory which is removed after the test
+func newTestDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "certbutler-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+// newTestSecret stores value in a file and returns a secret reading it
+func newTestSecret(t *testing.T, dir, value string) common.Secret {
+	file, err := ioutil.TempFile(dir, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if _, err = file.WriteString(value); err != nil {
+		t.Fatal(err)
+	}
+	return common.Secret{File: file.Name()}
+}
+
+// newTestCertificate creates a self-signed certificate and its key
+func newTestCertificate(t *testing.T) ([][]byte, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "example.com"},
+		DNSNames:     []string{"example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return [][]byte{der}, key
+}
+
+// TestStorageBackends runs the checks every storage backend has to pass against each backend
+func TestStorageBackends(t *testing.T) {
+	backends := []struct {
+		name      string
+		new       func(t *testing.T) Storage
+		dropsOCSP bool // a new certificate removes the OCSP response of the old one
+	}{
+		{"file", func(t *testing.T) Storage {
+			dir := newTestDir(t)
+			files := common.FilesConfiguration{CertFile: filepath.Join(dir, "cert.pem"), KeyFile: filepath.Join(dir, "key.pem")}
+			return NewFileStorage(files, filepath.Join(dir, "account.pem"))
+		}, false},
+		{"vault", func(t *testing.T) Storage {
+			_, server := newFakeVault(t)
+			return newTestVaultStorage(t, server.URL, "")
+		}, true},
+		{"s3", func(t *testing.T) Storage {
+			fake, server := newFakeS3(t)
+			return newTestS3Storage(t, common.S3Configuration{Endpoint: server.URL, Bucket: fake.bucket, PathStyle: true, Prefix: "example.com/", AccountKeyObject: "account.pem"})
+		}, true},
+	}
+	for _, backend := range backends {
+		t.Run(backend.name, func(t *testing.T) {
+			testStorage(t, backend.new(t), backend.dropsOCSP)
+		})
+	}
+}
+
+func testStorage(t *testing.T, s Storage, dropsOCSP bool) {
+	certs, key := newTestCertificate(t)
+
+	// empty storage
+	if _, err := s.GetCertificate(); err != ErrNotFound {
+		t.Errorf("GetCertificate returned %v, want ErrNotFound", err)
+	}
+	if _, err := s.GetKey(); err != ErrNotFound {
+		t.Errorf("GetKey returned %v, want ErrNotFound", err)
+	}
+	if _, err := s.GetOCSP(); err != ErrNotFound {
+		t.Errorf("GetOCSP returned %v, want ErrNotFound", err)
+	}
+	if _, err := s.GetAccountKey(); err != ErrNotFound {
+		t.Errorf("GetAccountKey returned %v, want ErrNotFound", err)
+	}
+	if items, err := s.List(); err != nil || len(items) != 0 {
+		t.Errorf("List returned %v, %v", items, err)
+	}
+
+	unlock, err := s.Lock()
+	if err != nil {
+		t.Fatalf("Lock failed: %v", err)
+	}
+	if err := s.PutCertificate(certs, key); err != nil {
+		t.Fatalf("PutCertificate failed: %v", err)
+	}
+	if err := s.PutOCSP([]byte{1, 2, 3}); err != nil {
+		t.Fatalf("PutOCSP failed: %v", err)
+	}
+	if err := s.PutAccountKey(key); err != nil {
+		t.Fatalf("PutAccountKey failed: %v", err)
+	}
+	unlock()
+
+	bundle, err := s.GetCertificate()
+	if err != nil {
+		t.Fatalf("GetCertificate failed: %v", err)
+	}
+	if len(bundle.Certificates) != 1 || string(bundle.Certificates[0].Raw) != string(certs[0]) {
+		t.Errorf("GetCertificate returned a different certificate")
+	}
+	storedKey, err := s.GetKey()
+	if err != nil {
+		t.Fatalf("GetKey failed: %v", err)
+	}
+	if storedKey.D.Cmp(key.D) != 0 {
+		t.Errorf("GetKey returned a different key")
+	}
+	ocspResponse, err := s.GetOCSP()
+	if err != nil || string(ocspResponse) != "\x01\x02\x03" {
+		t.Errorf("GetOCSP returned %v, %v", ocspResponse, err)
+	}
+	accountKey, err := s.GetAccountKey()
+	if err != nil {
+		t.Fatalf("GetAccountKey failed: %v", err)
+	}
+	if accountKey.D.Cmp(key.D) != 0 {
+		t.Errorf("GetAccountKey returned a different key")
+	}
+	if items, err := s.List(); err != nil || len(items) == 0 {
+		t.Errorf("List returned %v, %v", items, err)
+	}
+
+	// the lock is released, so it can be acquired again
+	unlock, err = s.Lock()
+	if err != nil {
+		t.Fatalf("Lock failed: %v", err)
+	}
+	unlock()
+
+	if err := s.PutCertificate(certs, key); err != nil {
+		t.Fatalf("PutCertificate failed: %v", err)
+	}
+	if _, err := s.GetOCSP(); dropsOCSP && err != ErrNotFound {
+		t.Errorf("GetOCSP after new certificate returned %v, want ErrNotFound", err)
+	}
+}
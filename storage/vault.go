@@ -0,0 +1,355 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"felix-hartmond.de/projects/certbutler/common"
+)
+
+const (
+	vaultDefaultMount        = "secret"
+	vaultDefaultAppRoleMount = "approle"
+	vaultTimeout             = 30 * time.Second
+
+	vaultFieldCertificate = "certificate"
+	vaultFieldChain       = "chain"
+	vaultFieldKey         = "key"
+	vaultFieldOCSP        = "ocsp"
+)
+
+var (
+	vaultLocks    = map[string]*sync.Mutex{}
+	vaultLocksMux sync.Mutex
+)
+
+// VaultStorage stores all items in a HashiCorp Vault KV version 2 secrets engine
+// Certificate, chain, key and OCSP response are stored as fields of one secret, so consumers can fetch them at once.
+type VaultStorage struct {
+	config      common.VaultConfiguration
+	accountFile *FileStorage // used for the account key if no account path is configured
+	client      *http.Client
+	token       string
+}
+
+type vaultSecret struct {
+	Data struct {
+		Data     map[string]string `json:"data"`
+		Metadata struct {
+			Version int `json:"version"`
+		} `json:"metadata"`
+	} `json:"data"`
+	Auth struct {
+		ClientToken string `json:"client_token"`
+	} `json:"auth"`
+}
+
+// NewVaultStorage creates a storage backend for a Vault KV v2 secrets engine
+func NewVaultStorage(config common.VaultConfiguration, accountFile *FileStorage) (*VaultStorage, error) {
+	if config.Address == "" || config.Path == "" {
+		return nil, fmt.Errorf("Vault storage needs address and path")
+	}
+	if config.Mount == "" {
+		config.Mount = vaultDefaultMount
+	}
+	config.Address = strings.TrimRight(config.Address, "/")
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if config.CACertFile != "" {
+		caBytes, err := ioutil.ReadFile(config.CACertFile)
+		if err != nil {
+			return nil, err
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(caBytes) {
+			return nil, fmt.Errorf("No certificates found in %s", config.CACertFile)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: roots}
+	}
+
+	return &VaultStorage{
+		config:      config,
+		accountFile: accountFile,
+		client:      &http.Client{Timeout: vaultTimeout, Transport: transport},
+	}, nil
+}
+
+// GetCertificate reads the certificate chain from the secret
+func (s *VaultStorage) GetCertificate() (*common.Bundle, error) {
+	data, _, err := s.readSecret(s.config.Path)
+	if err != nil {
+		return nil, err
+	}
+	if data[vaultFieldCertificate] == "" {
+		return nil, ErrNotFound
+	}
+	return common.ParseBundle([]byte(data[vaultFieldCertificate]))
+}
+
+// GetKey reads the private key from the secret
+func (s *VaultStorage) GetKey() (*ecdsa.PrivateKey, error) {
+	data, _, err := s.readSecret(s.config.Path)
+	if err != nil {
+		return nil, err
+	}
+	if data[vaultFieldKey] == "" {
+		return nil, ErrNotFound
+	}
+	return common.ParseKey([]byte(data[vaultFieldKey]), common.KeyEncryptionConfiguration{})
+}
+
+// PutCertificate writes certificate, chain and key to the secret. A stored OCSP response belongs to the old certificate and is removed.
+func (s *VaultStorage) PutCertificate(certs [][]byte, key *ecdsa.PrivateKey) error {
+	fullchain, err := common.EncodePem(nil, certs)
+	if err != nil {
+		return err
+	}
+	chain, err := common.EncodePem(nil, certs[1:])
+	if err != nil {
+		return err
+	}
+	keyPem, err := common.EncodePem(key, nil)
+	if err != nil {
+		return err
+	}
+
+	return s.updateSecret(s.config.Path, func(data map[string]string) {
+		data[vaultFieldCertificate] = string(fullchain)
+		data[vaultFieldChain] = string(chain)
+		data[vaultFieldKey] = string(keyPem)
+		delete(data, vaultFieldOCSP)
+	})
+}
+
+// GetOCSP reads the OCSP response from the secret
+func (s *VaultStorage) GetOCSP() ([]byte, error) {
+	data, _, err := s.readSecret(s.config.Path)
+	if err != nil {
+		return nil, err
+	}
+	if data[vaultFieldOCSP] == "" {
+		return nil, ErrNotFound
+	}
+	return base64.StdEncoding.DecodeString(data[vaultFieldOCSP])
+}
+
+// PutOCSP writes the base64 encoded OCSP response to the secret
+func (s *VaultStorage) PutOCSP(ocspResponse []byte) error {
+	return s.updateSecret(s.config.Path, func(data map[string]string) {
+		data[vaultFieldOCSP] = base64.StdEncoding.EncodeToString(ocspResponse)
+	})
+}
+
+// GetAccountKey reads the ACME account key from the account path or the local account file
+func (s *VaultStorage) GetAccountKey() (*ecdsa.PrivateKey, error) {
+	if s.config.AccountPath == "" {
+		return s.accountFile.GetAccountKey()
+	}
+	data, _, err := s.readSecret(s.config.AccountPath)
+	if err != nil {
+		return nil, err
+	}
+	if data[vaultFieldKey] == "" {
+		return nil, ErrNotFound
+	}
+	return common.ParseKey([]byte(data[vaultFieldKey]), common.KeyEncryptionConfiguration{})
+}
+
+// PutAccountKey writes the ACME account key to the account path or the local account file
+func (s *VaultStorage) PutAccountKey(key *ecdsa.PrivateKey) error {
+	if s.config.AccountPath == "" {
+		return s.accountFile.PutAccountKey(key)
+	}
+	keyPem, err := common.EncodePem(key, nil)
+	if err != nil {
+		return err
+	}
+	return s.updateSecret(s.config.AccountPath, func(data map[string]string) {
+		data[vaultFieldKey] = string(keyPem)
+	})
+}
+
+// List returns the fields stored in the secret
+func (s *VaultStorage) List() ([]string, error) {
+	data, _, err := s.readSecret(s.config.Path)
+	if err == ErrNotFound {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	items := []string{}
+	for field := range data {
+		items = append(items, s.config.Mount+"/"+s.config.Path+"#"+field)
+	}
+	sort.Strings(items)
+	return items, nil
+}
+
+// Lock serializes access to the secret within this process
+func (s *VaultStorage) Lock() (func(), error) {
+	vaultLocksMux.Lock()
+	id := s.config.Address + "/" + s.config.Mount + "/" + s.config.Path
+	lock, ok := vaultLocks[id]
+	if !ok {
+		lock = &sync.Mutex{}
+		vaultLocks[id] = lock
+	}
+	vaultLocksMux.Unlock()
+
+	lock.Lock()
+	return lock.Unlock, nil
+}
+
+// readSecret reads the latest version of a secret and returns its data and version
+// If the latest version is deleted, ErrNotFound is returned together with its version, which is needed to overwrite it.
+func (s *VaultStorage) readSecret(path string) (map[string]string, int, error) {
+	var secret vaultSecret
+	status, err := s.request(http.MethodGet, "/v1/"+s.config.Mount+"/data/"+path, nil, &secret)
+	if err != nil {
+		return nil, 0, err
+	}
+	if status == http.StatusNotFound || secret.Data.Data == nil {
+		return nil, secret.Data.Metadata.Version, ErrNotFound
+	}
+	return secret.Data.Data, secret.Data.Metadata.Version, nil
+}
+
+// updateSecret modifies the fields of a secret with check-and-set, so concurrent writers do not overwrite each other's fields
+func (s *VaultStorage) updateSecret(path string, update func(map[string]string)) error {
+	data, version, err := s.readSecret(path)
+	if err == ErrNotFound {
+		// the version of a deleted secret is kept, so that it is overwritten and not seen as conflict
+		data = map[string]string{}
+	} else if err != nil {
+		return err
+	}
+
+	update(data)
+
+	body := map[string]interface{}{
+		"options": map[string]int{"cas": version},
+		"data":    data,
+	}
+	_, err = s.request(http.MethodPost, "/v1/"+s.config.Mount+"/data/"+path, body, nil)
+	return err
+}
+
+// request sends an authenticated request to vault. A not found status of a read is returned without error.
+func (s *VaultStorage) request(method, path string, body interface{}, result interface{}) (int, error) {
+	token, err := s.getToken()
+	if err != nil {
+		return 0, err
+	}
+
+	status, err := s.send(method, path, token, body, result)
+	if status == http.StatusForbidden && s.config.AuthMethod == "approle" {
+		// token expired => login again
+		s.token = ""
+		if token, err = s.getToken(); err != nil {
+			return 0, err
+		}
+		status, err = s.send(method, path, token, body, result)
+	}
+	return status, err
+}
+
+func (s *VaultStorage) send(method, path, token string, body interface{}, result interface{}) (int, error) {
+	var requestBody []byte
+	if body != nil {
+		var err error
+		if requestBody, err = json.Marshal(body); err != nil {
+			return 0, err
+		}
+	}
+
+	request, err := http.NewRequest(method, s.config.Address+path, bytes.NewReader(requestBody))
+	if err != nil {
+		return 0, err
+	}
+	if token != "" {
+		request.Header.Set("X-Vault-Token", token)
+	}
+	if s.config.Namespace != "" {
+		request.Header.Set("X-Vault-Namespace", s.config.Namespace)
+	}
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+
+	response, err := s.client.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+
+	responseBody, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return response.StatusCode, err
+	}
+	if response.StatusCode == http.StatusNotFound && method == http.MethodGet {
+		// missing secret; for writes this means a missing mount or a wrong path, which must not be ignored
+		// The body of a deleted secret still holds its metadata, a missing secret has only an error list.
+		if result != nil && len(responseBody) > 0 {
+			json.Unmarshal(responseBody, result)
+		}
+		return response.StatusCode, nil
+	}
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return response.StatusCode, fmt.Errorf("Vault request %s %s failed with status %d: %s", method, path, response.StatusCode, strings.TrimSpace(string(responseBody)))
+	}
+	if result != nil && len(responseBody) > 0 {
+		if err = json.Unmarshal(responseBody, result); err != nil {
+			return response.StatusCode, err
+		}
+	}
+	return response.StatusCode, nil
+}
+
+// getToken returns the vault token for the configured auth method
+func (s *VaultStorage) getToken() (string, error) {
+	switch s.config.AuthMethod {
+	case "", "token":
+		// token from environment variable, file (e.g. vault agent sink) or systemd credential
+		token, err := s.config.Token.Read()
+		if err != nil {
+			return "", fmt.Errorf("Reading vault token failed: %v", err)
+		}
+		return token, nil
+	case "approle":
+		if s.token != "" {
+			return s.token, nil
+		}
+		secretID, err := s.config.SecretID.Read()
+		if err != nil {
+			return "", fmt.Errorf("Reading vault secret id failed: %v", err)
+		}
+		mount := s.config.AppRoleMount
+		if mount == "" {
+			mount = vaultDefaultAppRoleMount
+		}
+		var login vaultSecret
+		_, err = s.send(http.MethodPost, "/v1/auth/"+mount+"/login", "", map[string]string{"role_id": s.config.RoleID, "secret_id": secretID}, &login)
+		if err != nil {
+			return "", err
+		}
+		if login.Auth.ClientToken == "" {
+			return "", fmt.Errorf("Vault approle login returned no token")
+		}
+		s.token = login.Auth.ClientToken
+		return s.token, nil
+	default:
+		return "", fmt.Errorf("Unknown vault auth method %s", s.config.AuthMethod)
+	}
+}
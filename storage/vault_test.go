@@ -0,0 +1,248 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"felix-hartmond.de/projects/certbutler/common"
+)
+
+const (
+	vaultTestToken    = "test-token"
+	vaultTestRoleID   = "test-role"
+	vaultTestSecretID = "test-secret-id"
+)
+
+// fakeVault is a minimal KV v2 secrets engine mounted at "secret"
+type fakeVault struct {
+	mux         sync.Mutex
+	secrets     map[string]map[string]string
+	versions    map[string]int
+	deleted     map[string]bool // soft deleted secrets, whose latest version is kept
+	token       string          // token accepted by the server and returned by the approle login
+	logins      int
+	beforeWrite func() // called before a write is applied, e.g. to simulate a concurrent writer
+}
+
+func newFakeVault(t *testing.T) (*fakeVault, *httptest.Server) {
+	vault := &fakeVault{secrets: map[string]map[string]string{}, versions: map[string]int{}, deleted: map[string]bool{}, token: vaultTestToken}
+	server := httptest.NewServer(vault)
+	t.Cleanup(server.Close)
+	return vault, server
+}
+
+func (v *fakeVault) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/v1/auth/approle/login" && r.Method == http.MethodPost {
+		var body struct {
+			RoleID   string `json:"role_id"`
+			SecretID string `json:"secret_id"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.RoleID != vaultTestRoleID || body.SecretID != vaultTestSecretID {
+			http.Error(w, `{"errors":["invalid role or secret ID"]}`, http.StatusBadRequest)
+			return
+		}
+		v.mux.Lock()
+		v.logins++
+		token := v.token
+		v.mux.Unlock()
+		var login vaultSecret
+		login.Auth.ClientToken = token
+		json.NewEncoder(w).Encode(login)
+		return
+	}
+	v.mux.Lock()
+	token := v.token
+	v.mux.Unlock()
+	if r.Header.Get("X-Vault-Token") != token {
+		http.Error(w, `{"errors":["permission denied"]}`, http.StatusForbidden)
+		return
+	}
+	if !strings.HasPrefix(r.URL.Path, "/v1/secret/data/") {
+		http.Error(w, `{"errors":["no handler for route"]}`, http.StatusNotFound)
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, "/v1/secret/data/")
+
+	if r.Method == http.MethodPost && v.beforeWrite != nil {
+		v.beforeWrite()
+	}
+
+	v.mux.Lock()
+	defer v.mux.Unlock()
+	switch r.Method {
+	case http.MethodGet:
+		if v.deleted[path] {
+			// like vault, the metadata of the deleted version is returned with the 404
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, `{"data":{"data":null,"metadata":{"deletion_time":"2021-06-01T00:00:00Z","version":%d}}}`, v.versions[path])
+			return
+		}
+		data, ok := v.secrets[path]
+		if !ok {
+			http.Error(w, `{"errors":[]}`, http.StatusNotFound)
+			return
+		}
+		var secret vaultSecret
+		secret.Data.Data = data
+		secret.Data.Metadata.Version = v.versions[path]
+		json.NewEncoder(w).Encode(secret)
+	case http.MethodPost:
+		var body struct {
+			Options struct {
+				Cas int `json:"cas"`
+			} `json:"options"`
+			Data map[string]string `json:"data"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if body.Options.Cas != v.versions[path] {
+			http.Error(w, `{"errors":["check-and-set parameter did not match the current version"]}`, http.StatusBadRequest)
+			return
+		}
+		v.secrets[path] = body.Data
+		v.versions[path]++
+		delete(v.deleted, path)
+		w.Write([]byte(`{"data":{}}`))
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func newTestVaultStorage(t *testing.T, address, mount string) *VaultStorage {
+	s, err := NewVaultStorage(common.VaultConfiguration{
+		Address:     address,
+		Mount:       mount,
+		Path:        "certbutler/example.com",
+		AccountPath: "certbutler/account",
+		Token:       newTestSecret(t, newTestDir(t), vaultTestToken),
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestVaultWriteToMissingMount(t *testing.T) {
+	vault, server := newFakeVault(t)
+	s := newTestVaultStorage(t, server.URL, "missing")
+	certs, key := newTestCertificate(t)
+
+	if err := s.PutCertificate(certs, key); err == nil {
+		t.Fatal("PutCertificate to a missing mount succeeded")
+	}
+	if err := s.PutOCSP([]byte{1}); err == nil {
+		t.Fatal("PutOCSP to a missing mount succeeded")
+	}
+	if len(vault.secrets) != 0 {
+		t.Errorf("Secrets were written: %v", vault.secrets)
+	}
+}
+
+func TestVaultVersionConflict(t *testing.T) {
+	vault, server := newFakeVault(t)
+	s := newTestVaultStorage(t, server.URL, "")
+
+	if err := s.PutOCSP([]byte{1}); err != nil {
+		t.Fatalf("PutOCSP failed: %v", err)
+	}
+
+	// another writer updates the secret between read and write
+	vault.beforeWrite = func() {
+		vault.mux.Lock()
+		vault.versions["certbutler/example.com"]++
+		vault.mux.Unlock()
+	}
+	if err := s.PutOCSP([]byte{2}); err == nil {
+		t.Fatal("PutOCSP succeeded despite a version conflict")
+	}
+	vault.beforeWrite = nil
+
+	ocspResponse, err := s.GetOCSP()
+	if err != nil || string(ocspResponse) != "\x01" {
+		t.Errorf("GetOCSP returned %v, %v - the conflicting write must not be applied", ocspResponse, err)
+	}
+}
+
+func TestVaultWriteAfterDelete(t *testing.T) {
+	vault, server := newFakeVault(t)
+	s := newTestVaultStorage(t, server.URL, "")
+
+	if err := s.PutOCSP([]byte{1}); err != nil {
+		t.Fatalf("PutOCSP failed: %v", err)
+	}
+	// the latest version is soft deleted, e.g. with "vault kv delete"
+	vault.mux.Lock()
+	vault.deleted["certbutler/example.com"] = true
+	vault.mux.Unlock()
+
+	if _, err := s.GetOCSP(); err != ErrNotFound {
+		t.Errorf("GetOCSP of a deleted secret returned %v, want ErrNotFound", err)
+	}
+	if err := s.PutOCSP([]byte{2}); err != nil {
+		t.Fatalf("PutOCSP after delete failed: %v", err)
+	}
+	ocspResponse, err := s.GetOCSP()
+	if err != nil || string(ocspResponse) != "\x02" {
+		t.Errorf("GetOCSP returned %v, %v", ocspResponse, err)
+	}
+}
+
+func TestVaultAppRoleLogin(t *testing.T) {
+	vault, server := newFakeVault(t)
+	vault.token = "approle-token"
+	s, err := NewVaultStorage(common.VaultConfiguration{
+		Address:    server.URL,
+		Path:       "certbutler/example.com",
+		AuthMethod: "approle",
+		RoleID:     vaultTestRoleID,
+		SecretID:   newTestSecret(t, newTestDir(t), vaultTestSecretID),
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.PutOCSP([]byte{1}); err != nil {
+		t.Fatalf("PutOCSP failed: %v", err)
+	}
+	if _, err := s.GetOCSP(); err != nil {
+		t.Fatalf("GetOCSP failed: %v", err)
+	}
+	if vault.logins != 1 {
+		t.Errorf("Logged in %d times, want 1 - the token has to be reused", vault.logins)
+	}
+
+	// the token expires => certbutler has to log in again
+	vault.mux.Lock()
+	vault.token = "renewed-token"
+	vault.mux.Unlock()
+	if _, err := s.GetOCSP(); err != nil {
+		t.Fatalf("GetOCSP with expired token failed: %v", err)
+	}
+	if vault.logins != 2 {
+		t.Errorf("Logged in %d times, want 2", vault.logins)
+	}
+}
+
+func TestVaultAppRoleLoginFailure(t *testing.T) {
+	_, server := newFakeVault(t)
+	s, err := NewVaultStorage(common.VaultConfiguration{
+		Address:    server.URL,
+		Path:       "certbutler/example.com",
+		AuthMethod: "approle",
+		RoleID:     vaultTestRoleID,
+		SecretID:   newTestSecret(t, newTestDir(t), "wrong-secret-id"),
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.GetOCSP(); err == nil || err == ErrNotFound {
+		t.Errorf("GetOCSP with a wrong secret id returned %v, want a login error", err)
+	}
+}